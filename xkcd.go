@@ -10,18 +10,52 @@ a search term provided on the command line.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/gob"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"html/template"
+	"image"
+	_ "image/gif"		// Decoders for cached comic images
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
 )
 
 type Comic struct {
@@ -35,410 +69,6590 @@ type Comic struct {
 	Alt 		string `json:"alt"`
 	Img 		string `json:"img"`
 	Link 		string `json:"link"`
+	Interactive bool   `json:"interactive,omitempty"`	// Has extra parts beyond the image, e.g. #1350 "Lorenz"
 }
 
-type Index struct {
-	Comics 	map[int]*Comic	`json:"comics"`
-	LastNum int 			`json:"lastNum"`	// Number of latest comic
-	Updated time.Time 		`json:"updated"`
-}
+// rasterExts are the image formats xkcd.com publishes comics in
+var rasterExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true}
 
-type SearchResult struct {
-	Comic *Comic
-	Score int
+// isInteractive reports whether a comic has to be viewed online: it was
+// recorded as interactive, or it has no plain image to show. Indexes made
+// before the flag existed are still caught by the image check.
+func (c *Comic) isInteractive() bool {
+	return c.Interactive || !rasterExts[strings.ToLower(path.Ext(c.Img))]
 }
 
-const (
-	indexFile = "xkcd_index.json"		// saved json file
-	baseURL   = "https://xkcd.com/"
-	UserAgent = "xkcd-cli/1.0"
-)
-
-var client = http.Client{				// A custom client for more control over aspects like timeouts, 
-	Timeout: 10 * time.Second,			// redirect policies, and connection pooling.
+// Date assembles the publication date from the Year, Month and Day strings.
+// The API sends months and days without padding ("1", not "01"); a missing
+// or out-of-range component is an error rather than being normalized into
+// a different day, so every date feature agrees on which comics have one.
+func (c *Comic) Date() (time.Time, error) {
+	// Built only on failure: sorting by date calls this for every comparison
+	invalid := func() error {
+		return fmt.Errorf("comic #%d has an invalid date %q-%q-%q", c.Num, c.Year, c.Month, c.Day)
+	}
+	year, err1 := strconv.Atoi(strings.TrimSpace(c.Year))
+	month, err2 := strconv.Atoi(strings.TrimSpace(c.Month))
+	day, err3 := strconv.Atoi(strings.TrimSpace(c.Day))
+	if err1 != nil || err2 != nil || err3 != nil || year < 1 || month < 1 || month > 12 || day < 1 {
+		return time.Time{}, invalid()
+	}
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Day() != day {
+		return time.Time{}, invalid()
+	}
+	return date, nil
 }
 
-func fetchComic(num int) (*Comic, error) {
-	var url string
-	if num == 0 {
-		url = baseURL + "info.0.json"	// LATEST comic
-	} else {
-		url = baseURL + fmt.Sprintf("%d/info.0.json", num)
-	}
+// dateLayouts are the accepted date inputs, from most to least precise
+var dateLayouts = []string{"2006-01-02", "2006/01/02", "2006-01", "2006/01", "2006"}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// parseDate reads a date in any of dateLayouts. It returns the first day
+// of the period the input names and the first day after it, so "2015"
+// covers [2015-01-01, 2016-01-01).
+func parseDate(s string) (start, end time.Time, err error) {
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		switch len(layout) {
+		case len("2006"):
+			return t, t.AddDate(1, 0, 0), nil
+		case len("2006-01"):
+			return t, t.AddDate(0, 1, 0), nil
+		default:
+			return t, t.AddDate(0, 0, 1), nil
+		}
 	}
-	// Some websites block Go's default User-Agent "Go-http-client/1.1"
-	req.Header.Set("User-Agent", UserAgent)	
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q (use YYYY-MM-DD, YYYY/MM/DD, YYYY-MM or YYYY)", s)
+}
 
-	// The most flexible method, allowing create a custom http.Request object and then execute it
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// dateRange selects comics published within [from, to). Zero bounds are open.
+type dateRange struct {
+	from, to time.Time
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+// newDateRange builds a range from inclusive -after/-before inputs; either
+// may be empty
+func newDateRange(after, before string) (dateRange, error) {
+	var r dateRange
+	if after != "" {
+		start, _, err := parseDate(after)
+		if err != nil {
+			return r, err
+		}
+		r.from = start
 	}
-
-	var comic Comic
-	if err := json.NewDecoder(resp.Body).Decode(&comic); err != nil {
-		return nil, err
+	if before != "" {
+		_, end, err := parseDate(before)
+		if err != nil {
+			return r, err
+		}
+		r.to = end
 	}
-	return &comic, nil
+	return r, nil
 }
 
-func loadIndex() (*Index, error) {
-	// If error is [ErrNotExist], means that indexFile does NOT exist
-	if _, err := os.Stat(indexFile); errors.Is(err, fs.ErrNotExist) {
-		return &Index{
-			Comics: make(map[int]*Comic),
-			LastNum: 0,
-			Updated: time.Time{},
-		}, nil
-	}
+func (r dateRange) active() bool {
+	return !r.from.IsZero() || !r.to.IsZero()
+}
 
-	data, err := os.ReadFile(indexFile)
+// contains reports whether the comic falls in the range. Comics whose date
+// can't be parsed are excluded whenever the range is bounded.
+func (r dateRange) contains(comic *Comic) bool {
+	if !r.active() {
+		return true
+	}
+	date, err := comic.Date()
 	if err != nil {
-		return nil, err
+		return false
 	}
+	return (r.from.IsZero() || !date.Before(r.from)) && (r.to.IsZero() || date.Before(r.to))
+}
 
-	var index Index		// Index contains Comic type object, #, updated time
-	// If succeed, Unmarshal doesn't return anything, simply store data to &index
-	// If 2nd param is nil or not a pointer, return [InvalidUnmarshalError]
-	if err := json.Unmarshal(data, &index); err != nil {
-		return nil, err
-	}
+type Index struct {
+	Comics 	numberedMap[*Comic]	`json:"comics"`
+	LastNum int 			`json:"lastNum"`	// Number of latest comic
+	Updated time.Time 		`json:"updated"`
+	Checked time.Time 		`json:"checked,omitempty"`	// Last time update asked xkcd.com for the latest comic
+	Validators numberedMap[Validator] `json:"validators,omitempty"`	// For conditional refetches of indexed comics
+	Absent  []int			`json:"absent,omitempty"`	// Numbers xkcd.com confirmed don't exist, in order
+	WikiTranscripts []int	`json:"wikiTranscripts,omitempty"`	// Comics whose transcript came from explainxkcd, in order
 
-	if index.Comics == nil {
-		index.Comics = make(map[int]*Comic)
-	}
-	
-	return &index, nil
+	corpus map[*Comic]*comicText	// Lowercased search text, built by searchTexts as needed
+	words  *wordIndex				// Loaded or built by searchWords
+	path   string				// File the index was loaded from, if any
 }
 
-func saveIndex(index *Index) error {
-	// filepath.Dir("/foo/bar/baz.js") -> /foo/bar
-	dir := filepath.Dir(indexFile)
-	// MkdirAll creates a directory along with any necessary parents, and returns nil, 
-	// or else returns an error
-	// 0755 -> 7, 5, 5 (owner, group, others) -> rwx = ooo, oxo, oxo
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
+// numberedMap is a map keyed by comic number that marshals its keys in
+// numeric order. encoding/json sorts keys as strings, which is stable but
+// files comic #1000 between #100 and #101; in number order a saved index
+// only grows at the end, so it diffs well under version control. It
+// unmarshals like any map.
+type numberedMap[V any] map[int]V
 
-	data, err := json.MarshalIndent(index, "", "  ")
-	if err != nil {
-		return err
+func (m numberedMap[V]) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
 	}
-	// 6, 4, 4 -> oox, oxx, oxx
-	return os.WriteFile(indexFile, data, 0644)
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, num := range slices.Sorted(maps.Keys(m)) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value, err := json.Marshal(m[num])
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "%q:", strconv.Itoa(num))
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
 }
 
-func updateIndex() error {
-	fmt.Println("Loading existing index...")
-	index, err := loadIndex()
-	if err != nil {
-		return fmt.Errorf("failed to load index: %v", err)
-	}
+// knownGaps are comic numbers that were never published. #404 is, fittingly,
+// a "404 Not Found".
+var knownGaps = map[int]bool{404: true}
 
-	fmt.Println("Fetching latest comic to determine range...")
-	latest, err := fetchComic(0)	// Fetch LATEST comic, return *Comic
-	if err != nil {
-		return fmt.Errorf("failed to fetch latest comic: %v", err)
+// isAbsent reports whether num is a comic that doesn't exist, so updates
+// and backfill skip it and verify doesn't count it as missing
+func (index *Index) isAbsent(num int) bool {
+	_, found := slices.BinarySearch(index.Absent, num)
+	return knownGaps[num] || found
+}
+
+// markAbsent records that xkcd.com has no comic num
+func (index *Index) markAbsent(num int) {
+	if i, found := slices.BinarySearch(index.Absent, num); !found {
+		index.Absent = slices.Insert(index.Absent, i, num)
 	}
+}
 
-	fmt.Printf("Latest comic: #%d - %s\n", latest.Num, latest.Title)
+// hasWikiTranscript reports whether comic num's transcript was taken from
+// explainxkcd rather than xkcd.com
+func (index *Index) hasWikiTranscript(num int) bool {
+	_, found := slices.BinarySearch(index.WikiTranscripts, num)
+	return found
+}
 
-	// Confirm the range to be downloaded
-	startNum := 1
-	if index.LastNum > 0 {
-		startNum = index.LastNum + 1
+func (index *Index) markWikiTranscript(num int) {
+	if i, found := slices.BinarySearch(index.WikiTranscripts, num); !found {
+		index.WikiTranscripts = slices.Insert(index.WikiTranscripts, i, num)
 	}
+}
 
-	totalToFetch := 0
-	for i := startNum; i <= latest.Num; i++ {
-		if _, exist := index.Comics[i]; !exist {	// map access return val and bool
-			totalToFetch++
-		}
-	}
+// Validator holds the ETag and Last-Modified headers xkcd.com sent with a
+// comic. Sent back on a refetch, they let the server answer 304 Not
+// Modified instead of the whole comic.
+type Validator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
 
-	if totalToFetch == 0 {
-		fmt.Println("Index is already up to date.")
-		return nil
-	}
+// AuditEntry is one line of the append-only audit log, recording how a
+// saved index differed from the previous save
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Added   []int     `json:"added,omitempty"`
+	Updated []int     `json:"updated,omitempty"`
+	Removed []int     `json:"removed,omitempty"`
+	LastNum int       `json:"lastNum"`
+}
 
-	fmt.Printf("Need to fetch %d comics...\n", totalToFetch)
+// HistoryEntry records one comic viewed with show, random or open
+type HistoryEntry struct {
+	Num  int       `json:"num"`
+	Time time.Time `json:"time"`
+}
 
-	// Download the missing comics
-	fetched := 0
-	for i := startNum; i <= latest.Num; i++ {
-		if _, exists := index.Comics[i]; exists {
-			continue
-		}
+type SearchResult struct {
+	Comic   *Comic          `json:"comic"`
+	Score   int             `json:"score"`
+	Similar []*SearchResult `json:"similar,omitempty"`	// Lower-ranked near-duplicates folded into this result
+	Snippet string          `json:"snippet,omitempty"`	// Transcript text around the first match
+}
 
-		fmt.Printf("Fetching comic #%d... (%d/%d)\n", i, fetched+1, totalToFetch)
+// IndexStats is the -json form of the stats command
+type IndexStats struct {
+	Total    int            `json:"total"`
+	LastNum  int            `json:"lastNum"`
+	Updated  time.Time      `json:"updated"`
+	ByYear   map[string]int `json:"byYear,omitempty"`		// With -by year
+	TopTerms []TermCount    `json:"topTerms,omitempty"`	// With -by terms
+	TopWords []TermCount    `json:"topWords,omitempty"`	// With -by words
+}
 
-		comic, err := fetchComic(i)
-		if err != nil {
-			fmt.Printf("Warning: failed to fetch comic #%d: %v\n", i, err)
-			continue
-		}
+// TermCount is how many times a word occurs in the corpus
+type TermCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
 
-		if comic == nil {
-			fmt.Printf("Warning: comic #%d does not exist\n", i)
-			continue
-		}
+const (
+	indexFile   = "xkcd_index.json"		// legacy index name, still used if present in the working directory
+	imagesDir   = "images"				// default -images-dir, and the images folder of an exported gallery
+	baseURL     = "https://xkcd.com/"
+	explainBase = "https://www.explainxkcd.com/wiki/"
+	UserAgent   = "xkcd-cli/1.0"			// default for -user-agent
 
-		index.Comics[i] = comic
-		fetched++
+	retryBaseDelay = 500 * time.Millisecond	// First retry pause, doubled each attempt
 
-		// Add a small delay to avoid making requests too frequently
-		time.Sleep(100 * time.Millisecond)
+	maxComicSelection = 10000			// Most comics one show list or range may name
 
-		// Save progress every 50 comics to prevent data loss
-		if fetched%50 == 0 {
-			fmt.Printf("Saving progress... (%d/%d)\n", fetched, totalToFetch)
-			index.LastNum = i				// Update latest num of index
-			index.Updated = time.Now()		// Update updated time
-			if err := saveIndex(index); err != nil {
-				fmt.Printf("Warning: failed to save progress: %v\n", err)
-			}
-		}
-	}
+	wrapContinuation = "↩"				// Marks a word hard-wrapped across lines
+)
 
-	index.LastNum = latest.Num	
-	index.Updated = time.Now()
+// ANSI SGR sequences used by colorize
+const (
+	ansiReset = "\033[0m"
+	ansiBold  = "\033[1m"
+	ansiDim   = "\033[2m"
+	ansiCyan  = "\033[36m"
 
-	fmt.Printf("Saving index with %d comics...\n", len(index.Comics))
-	if err := saveIndex(index); err != nil {
-		return fmt.Errorf("failed to save index: %v", err)
-	}
+	// Matched search terms: yellow and underlined. Closed with its own
+	// reset so it can nest inside bold text without ending the bold.
+	ansiHighlight    = "\033[33;4m"
+	ansiHighlightEnd = "\033[39;24m"
+)
 
-	fmt.Printf("Successfully updated index! Fetched %d new comics.\n", fetched)
-	return nil
-}
+// Global flags, parsed in main before the command name
+var (
+	colorFlag      = flag.Bool("color", false, "force colored output, even when not writing to a terminal")
+	noColorFlag    = flag.Bool("no-color", false, "disable colored output")
+	jsonFlag       = flag.Bool("json", false, "print show, search, random and stats output as JSON")
+	indexFlag      = flag.String("index", "", "path of the index file (default $XKCD_INDEX or the user data directory)")
+	collectionFlag = flag.String("collection", "", "use the index of this named collection (see the use command)")
+	compressFlag   = flag.Bool("compress", false, "save the index gzip-compressed, as <index>.gz")
+	dbFlag         = flag.String("db", "", "keep the index in this SQLite database instead of a JSON file (needs a build with -tags sqlite)")
+	timeoutFlag    = flag.Duration("timeout", 10*time.Second, "time limit for each request to xkcd.com")
+	agentFlag      = flag.String("user-agent", UserAgent, "User-Agent header sent with every request")
+	proxyFlag      = flag.String("proxy", "", "proxy URL (http, https or socks5) overriding HTTP_PROXY/HTTPS_PROXY")
+	pagerFlag      = flag.Bool("pager", false, "page output even when it fits on one screen")
+	widthFlag      = flag.Int("width", 0, "wrap comics at this many columns (default: the terminal width)")
+	plainFlag      = flag.Bool("plain", false, "show comics as plain label: value lines without a box (default when not on a terminal)")
+	noPagerFlag    = flag.Bool("no-pager", false, "never pipe show, search and stats output through a pager")
+	verboseFlag    = flag.Bool("v", false, "print more detail about what commands are doing")
+	quietFlag      = flag.Bool("q", false, "only print warnings and errors besides command output")
+	imagesDirFlag  = flag.String("images-dir", imagesDir, "directory of the cached comic images, named <num>.<ext>")
+)
 
-func search(query string) ([]*SearchResult, error) {
-	index, err := loadIndex()
+// logLevel is how much status chatter commands write to stderr. stdout
+// is left for the output itself, so it can be piped or captured.
+type logLevel int
 
-	if err != nil {
-		return nil, err
+const (
+	levelQuiet   logLevel = iota	// -q: warnings and errors only
+	levelNormal
+	levelVerbose				// -v: also each step, such as index saves
+)
+
+var verbosity = levelNormal
+
+// infof prints a status message to stderr unless -q is given
+func infof(format string, args ...any) {
+	if verbosity >= levelNormal {
+		fmt.Fprintf(os.Stderr, format, args...)
 	}
+}
 
-	if len(index.Comics) == 0 {
-		return nil, fmt.Errorf("index is empty. Run 'update' first")
+// debugf prints a detail message to stderr only with -v
+func debugf(format string, args ...any) {
+	if verbosity >= levelVerbose {
+		fmt.Fprintf(os.Stderr, format, args...)
 	}
+}
 
-	query = strings.ToLower(query)
-	// Return []stirng. strings.Fields("  foo bar  baz   ") -> ["foo" "bar" "baz"],
-	terms := strings.Fields(query)	// Eliminate adundant space
+// warnf prints a warning to stderr at every level
+func warnf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format, args...)
+}
 
-	var results []*SearchResult		// Contains *Comic, score
+// newClient builds the HTTP client shared by every request. Without an
+// explicit proxy it honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func newClient(timeout time.Duration, proxy string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
 
-	for _, comic := range index.Comics {
-		score := calculateScore(comic, terms)
-		if score > 0 {
-			results = append(results, &SearchResult{
-				Comic: comic,
-				Score: score,
-			})
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https or socks5)", proxyURL.Scheme)
 		}
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
 
-	// Order by score
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].Score > results[j].Score
-	})
-
-	return results, nil
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
 }
 
-func calculateScore(comic *Comic, terms []string) int {
-	score := 0
-	
-	// Merge all texts and convert to lower case
-	allText := strings.ToLower(fmt.Sprintf("%s %s %s %s", 
-		comic.Title, comic.SafeTitle, comic.Alt, comic.Transcript))
+// rateLimiter spaces requests evenly at a fixed rate. A single limiter is
+// shared by every worker, so the total request rate stays polite however
+// many fetches run concurrently.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
 
-	for _, term := range terms {
-		// Title matches receive higher scores
-		// if title contains the words in terms (searching keywords)
-		if strings.Contains(strings.ToLower(comic.Title), term) {
-			score += 10
-		}
-		if strings.Contains(strings.ToLower(comic.SafeTitle), term) {
-			score += 8
-		}
-		// Alt match
-		if strings.Contains(strings.ToLower(comic.Alt), term) {
-			score += 5
-		}
-		// Transcript match
-		if strings.Contains(strings.ToLower(comic.Transcript), term) {
-			score += 3
-		}
-		// allText match
-		if strings.Contains(allText, term) {
-			score += 1
-		}
+// newRateLimiter returns a limiter allowing perSecond requests per second,
+// or nil (no limit) when perSecond is not positive
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
 	}
-	return score
+	return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / perSecond))}
 }
 
-func displayComic(comic *Comic) {
-	fmt.Printf("┌─ XKCD #%d ─────────────────────────────────────\n", comic.Num)
-	fmt.Printf("│ Title: %s\n", comic.Title)
-	fmt.Printf("│ Date:  %s-%s-%s\n", comic.Year, comic.Month, comic.Day)
-	fmt.Printf("│ URL:   %s/%d/\n", baseURL, comic.Num)
-	fmt.Printf("│ Image: %s\n", comic.Img)
-	if comic.Link != "" {
-		fmt.Printf("│ Link:  %s\n", comic.Link)
+// Wait blocks until the next request may be sent, or ctx is canceled
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
 	}
-	fmt.Printf("├─ Alt Text ──────────────────────────────────────\n")
-	fmt.Printf("│ %s\n", wrapText(comic.Alt, 60))
-	if comic.Transcript != "" {
-		fmt.Printf("├─ Transcript ────────────────────────────────────\n")
-		fmt.Printf("│ %s\n", wrapText(comic.Transcript, 60))
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	fmt.Printf("└─────────────────────────────────────────────────\n")
 }
 
-func wrapText(text string, width int) string {
-	if len(text) <= width {
-		return text
+// fetcher performs every request to xkcd.com, pacing them through its limiter
+type fetcher struct {
+	client    *http.Client
+	userAgent string
+	limiter   *rateLimiter
+	rate      float64	// Requests per second allowed by limiter; 0 is unlimited
+	retries   int		// Extra attempts after a transient failure
+
+	mu       sync.Mutex
+	resumeAt time.Time	// Set by a Retry-After header; no request is sent before it
+}
+
+// newFetcher sends requests through client, which main builds from the
+// global flags, identifying itself as userAgent
+func newFetcher(client *http.Client, userAgent string, rate float64, retries int) *fetcher {
+	return &fetcher{
+		client:    client,
+		userAgent: userAgent,
+		limiter:   newRateLimiter(rate),
+		rate:      rate,
+		retries:   retries,
 	}
+}
 
-	var lines []string
-	words := strings.Fields(text)
-	currentLine := ""
+// Errors returned by fetchComic; callers branch on them with errors.Is
+var (
+	// ErrComicNotFound means xkcd.com answered 404: the comic doesn't exist
+	ErrComicNotFound = errors.New("comic not found")
 
-	for _, word := range words {
-		if len(currentLine)+len(word)+1 <= width {
-			if currentLine == "" {
-				currentLine = word
-			} else {
-				currentLine += " " + word
-			}
-		} else {
-			if currentLine != "" {
-				lines = append(lines, currentLine)
-			}
-			currentLine = word
-		}
+	// ErrNotModified is returned by a conditional fetch when the comic is
+	// unchanged since its validator was recorded
+	ErrNotModified = errors.New("comic not modified")
+)
+
+// StatusError reports any other non-200 response from xkcd.com
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration	// Requested by a 429 or 503 response; 0 if not given
+}
+
+func (e *StatusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("unexpected status code: %d (retry after %v)", e.Code, e.RetryAfter)
 	}
+	return fmt.Sprintf("unexpected status code: %d", e.Code)
+}
 
-	if currentLine != "" {
-		lines = append(lines, currentLine)
+// newStatusError describes a failed response, reading its Retry-After
+// header when the server is throttling or temporarily unavailable
+func newStatusError(resp *http.Response) *StatusError {
+	err := &StatusError{Code: resp.StatusCode}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 	}
+	return err
+}
 
-	return strings.Join(lines, "\n│ ")
+// parseRetryAfter reads a Retry-After value, either a number of seconds
+// ("120") or an HTTP date, as a duration from now. It returns 0 for a
+// missing or malformed value, or a date in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
 }
 
-func showStats() error {
-	index, err := loadIndex()
-	if err != nil {
-		return err
+// retryable reports whether a failed fetch may succeed if tried again:
+// network errors, rate limiting (429) and 5xx responses are transient,
+// anything else (a missing comic, a malformed body) will fail the same
+// way every time
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == http.StatusTooManyRequests || statusErr.Code >= 500
 	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
 
-	fmt.Printf("XKCD Index Statistics\n")
-	fmt.Printf("═══════════════════════\n")
-	fmt.Printf("Total comics indexed: %d\n", len(index.Comics))
-	fmt.Printf("Last comic number:    %d\n", index.LastNum)
-	fmt.Printf("Last updated:         %s\n", index.Updated.Format("2006-01-02 15:04:05"))
-	
-	if len(index.Comics) > 0 {
-		fmt.Printf("\nSample comics:\n")
-		// Display oldest and latest 5 comics
-		var nums []int
-		for num := range index.Comics {
-			nums = append(nums, num)
-		}
-		sort.Ints(nums)
+// maxRetryAfter is the longest Retry-After a fetch waits out; a server
+// asking for more is treated as a failure, to be retried by a later run
+const maxRetryAfter = 10 * time.Minute
 
-		count := 0
-		for _, num := range nums {
-			if count >= 5 {
-				break
+// retry calls fetch until it succeeds, fails permanently, runs out of
+// retries or ctx is canceled. Between attempts it waits as long as a
+// Retry-After header asked, pausing every request of f meanwhile, or
+// else backs off exponentially. what names the request in messages.
+func (f *fetcher) retry(ctx context.Context, what string, fetch func() error) error {
+	err := fetch()
+	for attempt := 0; attempt < f.retries && err != nil && retryable(err) && ctx.Err() == nil; attempt++ {
+		delay := backoff(attempt)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			if statusErr.RetryAfter > maxRetryAfter {
+				return err
 			}
-			comic := index.Comics[num]
-			fmt.Printf("  #%d: %s\n", num, comic.Title)
-			count++
+			delay = statusErr.RetryAfter
+			f.pause(delay)
 		}
-
-		if len(nums) > 10 {
-			fmt.Printf("  ...\n")
-			for i := len(nums) - 5; i < len(nums); i++ {
-				num := nums[i]
-				comic := index.Comics[num]
-				fmt.Printf("  #%d: %s\n", num, comic.Title)
-			}
+		infof("Retrying %s in %v after error: %v\n", what, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+		err = fetch()
 	}
-	return nil
+	return err
 }
 
-func showRandom() error {
-	index, err := loadIndex()
-	if err != nil {
-		return err
-	}
-
-	if len(index.Comics) == 0 {
-		return fmt.Errorf("index is empty. Please run 'update' first")
+// pause holds back every request of f for d, since a Retry-After applies
+// to the client, not just the request that received it
+func (f *fetcher) pause(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if until := time.Now().Add(d); until.After(f.resumeAt) {
+		f.resumeAt = until
 	}
+}
 
-	// Fetch random comics
-	var nums []int
-	for num := range index.Comics {
-		nums = append(nums, num)
+// wait blocks until a request may be sent: after any pause requested by
+// the server, and then when the rate limiter allows
+func (f *fetcher) wait(ctx context.Context) error {
+	f.mu.Lock()
+	delay := time.Until(f.resumeAt)
+	f.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return f.limiter.Wait(ctx)
+}
 
-	randomIndex := time.Now().UnixNano() % int64(len(nums))
-	randomNum := nums[randomIndex]
-	comic := index.Comics[randomNum]
+// backoff is the pause before retry number attempt (0-based): exponential
+// from retryBaseDelay, plus up to 50% random jitter so that concurrent
+// workers don't retry in lockstep
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	return delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
-	fmt.Println("Random XKCD Comic:")
-	displayComic(comic)
+// fetchComic fetches a comic, retrying transient failures with backoff
+// until ctx is canceled
+func (f *fetcher) fetchComic(ctx context.Context, num int) (*Comic, error) {
+	comic, _, err := f.fetchComicIfChanged(ctx, num, Validator{})
+	return comic, err
+}
 
-	return nil
+// fetchComicIfChanged is fetchComic sending the validator of the indexed
+// copy, if any. It returns ErrNotModified when the comic hasn't changed,
+// and otherwise the validator to send next time.
+func (f *fetcher) fetchComicIfChanged(ctx context.Context, num int, v Validator) (*Comic, Validator, error) {
+	var comic *Comic
+	var next Validator
+	err := f.retry(ctx, fmt.Sprintf("comic #%d", num), func() error {
+		var err error
+		comic, next, err = f.fetchComicOnce(ctx, num, v)
+		return err
+	})
+	return comic, next, err
 }
 
-func showComic(numStr string) error {
-	num, err := strconv.Atoi(numStr)
+func (f *fetcher) fetchComicOnce(ctx context.Context, num int, v Validator) (*Comic, Validator, error) {
+	var url string
+	if num == 0 {
+		url = baseURL + "info.0.json"	// LATEST comic
+	} else {
+		url = baseURL + fmt.Sprintf("%d/info.0.json", num)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("invalid comic number: %s", numStr)
+		return nil, Validator{}, err
+	}
+	// Some websites block Go's default User-Agent "Go-http-client/1.1"
+	req.Header.Set("User-Agent", f.userAgent)	
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
 	}
 
-	index, err := loadIndex()
+	if err := f.wait(ctx); err != nil {
+		return nil, Validator{}, err
+	}
+
+	// The most flexible method, allowing create a custom http.Request object and then execute it
+	resp, err := f.client.Do(req)
 	if err != nil {
-		return err
+		return nil, Validator{}, err
 	}
+	defer resp.Body.Close()
 
-	comic, exists := index.Comics[num]
-	if !exists {
-		return fmt.Errorf("comic #%d not found in index", num)
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, v, ErrNotModified
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, Validator{}, ErrComicNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, Validator{}, newStatusError(resp)
 	}
 
-	displayComic(comic)
-	return nil
+	comic, err := decodeComic(resp.Body, num)
+	if err != nil {
+		return nil, Validator{}, err
+	}
+	next := Validator{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return comic, next, nil
 }
 
-func printUsage() {
-	fmt.Println("XKCD Offline Tool")
-	fmt.Println("═════════════════")
+// decodeComic reads a comic in the format of xkcd.com's info.0.json.
+// Unknown fields are ignored and missing ones left empty; a missing number
+// is taken from num, unless that is 0. Interactive comics (#1350, #1608,
+// ...) describe their scripts in extra_parts.
+func decodeComic(r io.Reader, num int) (*Comic, error) {
+	var data struct {
+		Comic
+		ExtraParts json.RawMessage `json:"extra_parts"`
+	}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	comic := data.Comic
+	if comic.Num == 0 && num != 0 {
+		comic.Num = num
+	}
+	if comic.SafeTitle == "" {
+		comic.SafeTitle = comic.Title
+	}
+	comic.Interactive = len(data.ExtraParts) > 0 && string(data.ExtraParts) != "null"
+	return &comic, nil
+}
+
+// fetchTranscript looks up a comic's transcript on explainxkcd.com, which
+// transcribes the newer comics xkcd.com has none for. It returns "" when
+// the wiki has no transcript for the comic yet.
+func (f *fetcher) fetchTranscript(ctx context.Context, num int) (string, error) {
+	var transcript string
+	err := f.retry(ctx, fmt.Sprintf("transcript #%d", num), func() error {
+		var err error
+		transcript, err = f.fetchTranscriptOnce(ctx, num)
+		return err
+	})
+	return transcript, err
+}
+
+func (f *fetcher) fetchTranscriptOnce(ctx context.Context, num int) (string, error) {
+	// The MediaWiki API returns the page source. The page named after the
+	// number redirects to the comic's page.
+	params := url.Values{
+		"action":        {"parse"},
+		"page":          {strconv.Itoa(num)},
+		"prop":          {"wikitext"},
+		"redirects":     {"1"},
+		"format":        {"json"},
+		"formatversion": {"2"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", explainBase+"api.php?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+
+	if err := f.wait(ctx); err != nil {
+		return "", err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+
+	var page struct {
+		Parse struct {
+			Wikitext string `json:"wikitext"`
+		} `json:"parse"`
+		Error *struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return "", err
+	}
+	if page.Error != nil {
+		if page.Error.Code == "missingtitle" {
+			return "", nil		// No page for this comic yet
+		}
+		return "", fmt.Errorf("explainxkcd: %s", page.Error.Code)
+	}
+	return wikiTranscript(page.Parse.Wikitext), nil
+}
+
+var (
+	wikiHeading  = regexp.MustCompile(`(?m)^(==+)\s*(.*?)\s*==+\s*$`)
+	wikiTemplate = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+	wikiLink     = regexp.MustCompile(`\[\[(?:[^|\]]*\|)?([^\]]*)\]\]`)
+	wikiExtLink  = regexp.MustCompile(`\[https?://\S+\s+([^\]]*)\]`)
+	wikiMarkup   = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]+>|'{2,}`)
+)
+
+// wikiTranscript extracts the Transcript section of an explainxkcd page
+// as plain text, without templates, links and formatting
+func wikiTranscript(wikitext string) string {
+	var section string
+	headings := wikiHeading.FindAllStringSubmatchIndex(wikitext, -1)
+	for i, h := range headings {
+		if !strings.EqualFold(wikitext[h[4]:h[5]], "transcript") {
+			continue
+		}
+		end := len(wikitext)
+		for _, next := range headings[i+1:] {
+			if next[3]-next[2] <= h[3]-h[2] {	// Same level or higher
+				end = next[0]
+				break
+			}
+		}
+		section = wikitext[h[1]:end]
+		break
+	}
+
+	section = wikiHeading.ReplaceAllString(section, "")	// Subsections
+
+	// Templates nest, so strip them from the inside out
+	for {
+		stripped := wikiTemplate.ReplaceAllString(section, "")
+		if stripped == section {
+			break
+		}
+		section = stripped
+	}
+	section = wikiLink.ReplaceAllString(section, "$1")
+	section = wikiExtLink.ReplaceAllString(section, "$1")
+	section = html.UnescapeString(wikiMarkup.ReplaceAllString(section, ""))
+
+	var lines []string
+	for _, line := range strings.Split(section, "\n") {
+		if line = strings.TrimSpace(strings.TrimLeft(line, ":*#")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// resolveIndexPath picks the index file: the -index flag, then the
+// -collection flag, then $XKCD_INDEX, then the collection selected with
+// use, then an xkcd_index.json in the working directory (where older
+// versions kept it), then $XDG_DATA_HOME/xkcd/index.json or ~/.xkcd/index.json
+func resolveIndexPath(flagPath, collection string) (string, error) {
+	if flagPath != "" {
+		return flagPath, nil
+	}
+	if collection != "" {
+		return collectionPath(collection)
+	}
+	if env := os.Getenv("XKCD_INDEX"); env != "" {
+		return env, nil
+	}
+	if active := activeCollection(); active != "" {
+		return collectionPath(active)
+	}
+	if _, err := os.Stat(indexFile); err == nil {
+		return indexFile, nil
+	}
+	if dir := dataDir(); dir != "" {
+		return filepath.Join(dir, "index.json"), nil
+	}
+	return indexFile, nil
+}
+
+// dataDir is where the index lives by default: $XDG_DATA_HOME/xkcd or
+// ~/.xkcd ("" if neither can be determined)
+func dataDir() string {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "xkcd")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".xkcd")
+	}
+	return ""
+}
+
+// collectionsDir holds one subdirectory per named collection, each with
+// its own xkcd_index.json, plus the active file written by use
+func collectionsDir() string {
+	return filepath.Join(dataDir(), "collections")
+}
+
+// activeCollectionFile records the collection selected with use
+func activeCollectionFile() string {
+	return filepath.Join(collectionsDir(), "active")
+}
+
+// collectionPath is the index file of the named collection. Names are
+// single path elements, so a collection can't point outside the base
+// directory.
+func collectionPath(name string) (string, error) {
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid collection name %q", name)
+	}
+	return filepath.Join(collectionsDir(), name, indexFile), nil
+}
+
+// activeCollection returns the collection selected with use, or "" for
+// none
+func activeCollection() string {
+	data, err := os.ReadFile(activeCollectionFile())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// useCollection makes name the collection commands use when neither
+// -index nor -collection is given. An empty name goes back to the
+// default index.
+func useCollection(name string) error {
+	if name == "" {
+		if err := os.Remove(activeCollectionFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		infof("Using the default index\n")
+		return nil
+	}
+
+	path, err := collectionPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("creating collection %q: %v", name, err)
+	}
+	if err := os.WriteFile(activeCollectionFile(), []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		infof("Using new collection %q; run 'update' to fill it\n", name)
+	} else {
+		infof("Using collection %q\n", name)
+	}
+	return nil
+}
+
+// listCollections prints the collection names, marking the active one
+// with * like git branch
+func listCollections(w io.Writer) error {
+	entries, err := os.ReadDir(collectionsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	active := activeCollection()
+	found := false
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		found = true
+		mark := " "
+		if entry.Name() == active {
+			mark = "*"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", mark, entry.Name()); err != nil {
+			return err
+		}
+	}
+	if !found {
+		infof("No collections yet. Create one with 'use <name>'.\n")
+	}
+	return nil
+}
+
+// imagePath is where a comic's image is cached, named by comic number and
+// keeping the extension of the original (e.g. images/353.png)
+func imagePath(comic *Comic) string {
+	ext := path.Ext(comic.Img)
+	if ext == "" {
+		ext = ".png"
+	}
+	return filepath.Join(*imagesDirFlag, fmt.Sprintf("%d%s", comic.Num, ext))
+}
+
+// cachedImage returns the local path of the comic's image, or "" if it
+// hasn't been downloaded
+func cachedImage(comic *Comic) string {
+	if comic.Img == "" {
+		return ""
+	}
+	p := imagePath(comic)
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// fetchImage downloads the comic's image into the image cache, retrying
+// transient failures like fetchComic. It returns the size of the image.
+func (f *fetcher) fetchImage(ctx context.Context, comic *Comic) (int64, error) {
+	var size int64
+	err := f.retry(ctx, fmt.Sprintf("the image of comic #%d", comic.Num), func() error {
+		var err error
+		size, err = f.fetchImageOnce(ctx, comic)
+		return err
+	})
+	return size, err
+}
+
+// fetchImageOnce downloads an image once. The file is written under a
+// temporary name and renamed, so an interrupted download never leaves a
+// truncated image that looks cached.
+func (f *fetcher) fetchImageOnce(ctx context.Context, comic *Comic) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", comic.Img, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+
+	if err := f.wait(ctx); err != nil {
+		return 0, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, newStatusError(resp)
+	}
+	// An error page served with 200 mustn't be cached as the image
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/") {
+		return 0, fmt.Errorf("not an image (Content-Type %q)", contentType)
+	}
+
+	if err := os.MkdirAll(*imagesDirFlag, 0755); err != nil {
+		return 0, err
+	}
+
+	dest := imagePath(comic)
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, resp.Body)
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return size, os.Rename(tmp, dest)
+}
+
+// downloadImages caches the image of every indexed comic that doesn't have
+// one on disk yet, fetching with a pool of workers. They share f's rate
+// limit, so images and comics together stay within -rate.
+func downloadImages(ctx context.Context, store Store, f *fetcher, workers int, mode progressMode) error {
+	index, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load index: %v", err)
+	}
+
+	var missing []*Comic
+	for _, comic := range index.Comics {
+		if comic.Img != "" && cachedImage(comic) == "" {
+			missing = append(missing, comic)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Num < missing[j].Num
+	})
+
+	if len(missing) == 0 {
+		infof("All images are already cached.\n")
+		return nil
+	}
+
+	infof("Downloading %d images into %s/ with %d workers...\n", len(missing), *imagesDirFlag, max(1, workers))
+	p := newProgress(mode, len(missing))
+
+	type result struct {
+		comic *Comic
+		size  int64
+		err   error
+	}
+	jobs := make(chan *Comic)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for comic := range jobs {
+				size, err := f.fetchImage(ctx, comic)
+				results <- result{comic: comic, size: size, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, comic := range missing {
+			select {
+			case jobs <- comic:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	downloaded := 0
+	var total int64
+	for res := range results {
+		switch {
+		case res.err != nil && ctx.Err() != nil:
+		case res.err != nil:
+			p.warnf("failed to fetch image for comic #%d: %v\n", res.comic.Num, res.err)
+			p.step("")
+		default:
+			downloaded++
+			total += res.size
+			p.step(fmt.Sprintf("Fetched image for comic #%d", res.comic.Num))
+		}
+	}
+	p.finish()
+
+	if ctx.Err() != nil {
+		infof("Interrupted after downloading %d images (%s).\n", downloaded, formatBytes(total))
+		return nil
+	}
+	infof("Downloaded %d images (%s).\n", downloaded, formatBytes(total))
+	return nil
+}
+
+// formatBytes renders a size in bytes with a binary unit: 1536 -> "1.5 KiB"
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < 3 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, []string{"KiB", "MiB", "GiB", "TiB"}[unit])
+}
+
+// Store persists the index and its audit log, decoupling commands from the
+// storage format. jsonStore is the default; builds with -tags sqlite add
+// sqliteStore for -db.
+type Store interface {
+	Load() (*Index, error)
+	Save(index *Index) error
+	// Get looks up a single comic; exists is false if it isn't indexed
+	Get(num int) (comic *Comic, exists bool, err error)
+
+	AppendAudit(entry AuditEntry) error
+	LoadAudit() ([]AuditEntry, error)
+
+	// Favorites are the comic numbers the user bookmarked, in order
+	LoadFavorites() ([]int, error)
+	SaveFavorites(nums []int) error
+	// Tags are the user's labels per comic, lowercased and sorted
+	LoadTags() (map[int][]string, error)
+	SaveTags(tags map[int][]string) error
+	// History is the comics viewed most recently, oldest first
+	LoadHistory() ([]HistoryEntry, error)
+	SaveHistory(entries []HistoryEntry) error
+
+	// Restore swaps the index with the backup Save keeps of the previous one
+	Restore() error
+}
+
+// openDB opens the SQLite store for -db. It is nil unless built with
+// -tags sqlite (see xkcd_sqlite.go), which keeps the default build free of
+// a database driver.
+var openDB func(path string) (Store, error)
+
+// jsonStore keeps the index in one JSON file, with the checksum and audit
+// log as companion files beside it
+type jsonStore struct {
+	path     string
+	compress bool	// Save as gzip, under path + ".gz"
+}
+
+// file is the index file currently in use: path or its gzipped sibling
+// path + ".gz", whichever exists, preferring the more recently saved. This
+// way a compressed index keeps being used without -compress, and the first
+// -compress save still starts from the existing plain index.
+func (s *jsonStore) file() string {
+	if strings.HasSuffix(s.path, ".gz") {
+		return s.path
+	}
+	gz := s.path + ".gz"
+
+	plainInfo, plainErr := os.Stat(s.path)
+	gzInfo, gzErr := os.Stat(gz)
+	switch {
+	case gzErr != nil:
+		return s.path
+	case plainErr != nil || gzInfo.ModTime().After(plainInfo.ModTime()):
+		return gz
+	}
+	return s.path
+}
+
+// saveFile is where Save writes: the gzipped sibling under -compress
+func (s *jsonStore) saveFile() string {
+	if s.compress && !strings.HasSuffix(s.path, ".gz") {
+		return s.path + ".gz"
+	}
+	return s.file()
+}
+
+func (s *jsonStore) Load() (*Index, error) {
+	return loadIndex(s.file())
+}
+
+func (s *jsonStore) Save(index *Index) error {
+	return saveIndex(s.saveFile(), index)
+}
+
+// Get has to parse the whole file; a JSON index has no per-comic access
+func (s *jsonStore) Get(num int) (*Comic, bool, error) {
+	index, err := s.Load()
+	if err != nil {
+		return nil, false, err
+	}
+	comic, exists := index.Comics[num]
+	return comic, exists, nil
+}
+
+// The audit log stays beside path, so compressing the index doesn't
+// start a new history
+func (s *jsonStore) AppendAudit(entry AuditEntry) error {
+	return appendAudit(s.path, entry)
+}
+
+func (s *jsonStore) LoadAudit() ([]AuditEntry, error) {
+	return loadAudit(s.path)
+}
+
+func (s *jsonStore) LoadFavorites() ([]int, error) {
+	var nums []int
+	err := loadSideFile(favoritesFile(s.path), &nums)
+	return nums, err
+}
+
+func (s *jsonStore) SaveFavorites(nums []int) error {
+	return saveSideFile(favoritesFile(s.path), nums)
+}
+
+func (s *jsonStore) LoadTags() (map[int][]string, error) {
+	tags := make(map[int][]string)
+	err := loadSideFile(tagsFile(s.path), &tags)
+	return tags, err
+}
+
+func (s *jsonStore) SaveTags(tags map[int][]string) error {
+	return saveSideFile(tagsFile(s.path), tags)
+}
+
+func (s *jsonStore) LoadHistory() ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := loadSideFile(historyFile(s.path), &entries)
+	return entries, err
+}
+
+func (s *jsonStore) SaveHistory(entries []HistoryEntry) error {
+	return saveSideFile(historyFile(s.path), entries)
+}
+
+func (s *jsonStore) Restore() error {
+	return restoreIndex(s.file())
+}
+
+// favoritesFile holds the bookmarked comic numbers as a JSON array
+func favoritesFile(indexPath string) string {
+	return indexPath + ".favorites.json"
+}
+
+// tagsFile holds the tags as a JSON object from comic number to tags
+func tagsFile(indexPath string) string {
+	return indexPath + ".tags.json"
+}
+
+// historyFile holds the recently viewed comics as a JSON array
+func historyFile(indexPath string) string {
+	return indexPath + ".history.json"
+}
+
+// loadSideFile decodes one of the small JSON files kept beside the index
+// into v, leaving v untouched if the file doesn't exist yet
+func loadSideFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("corrupt file %s: %v", path, err)
+	}
+	return nil
+}
+
+func saveSideFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+func loadIndex(indexPath string) (*Index, error) {
+	// If error is [ErrNotExist], means that the index does NOT exist yet
+	if _, err := os.Stat(indexPath); errors.Is(err, fs.ErrNotExist) {
+		return &Index{
+			Comics: make(map[int]*Comic),
+			LastNum: 0,
+			Updated: time.Time{},
+		}, nil
+	}
+
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// A mismatch only warns: the index may still be usable, and the user
+	// decides whether to trust it
+	if stored, err := readChecksum(indexPath); err == nil && stored != "" && stored != checksum(data) {
+		warnf("%s does not match its checksum and may be corrupt or modified. Run 'verify-index' for details\n", indexPath)
+	}
+
+	// Detect gzip by its magic bytes rather than the name, so a compressed
+	// index loads whatever it is called
+	if bytes.HasPrefix(data, gzipMagic) {
+		if data, err = gunzip(data); err != nil {
+			return nil, corruptIndexError(indexPath, err)
+		}
+	}
+
+	var index Index		// Index contains Comic type object, #, updated time
+	// If succeed, Unmarshal doesn't return anything, simply store data to &index
+	// If 2nd param is nil or not a pointer, return [InvalidUnmarshalError]
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, corruptIndexError(indexPath, err)
+	}
+
+	if index.Comics == nil {
+		index.Comics = make(map[int]*Comic)
+	}
+	index.path = indexPath
+	
+	return &index, nil
+}
+
+// corruptIndexError explains an unreadable index in terms of what to do
+// about it; the raw decoding error is kept at the end for reference
+func corruptIndexError(indexPath string, err error) error {
+	return fmt.Errorf("index %s is corrupt, probably from an interrupted save; move it aside and run 'update' to rebuild it (%v)", indexPath, err)
+}
+
+func saveIndex(indexPath string, index *Index) error {
+	// filepath.Dir("/foo/bar/baz.js") -> /foo/bar
+	dir := filepath.Dir(indexPath)
+	// MkdirAll creates a directory along with any necessary parents, and returns nil, 
+	// or else returns an error
+	// 0755 -> 7, 5, 5 (owner, group, others) -> rwx = ooo, oxo, oxo
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(indexPath, ".gz") {
+		if data, err = gzipBytes(data); err != nil {
+			return err
+		}
+	}
+	if err := backupIndex(indexPath); err != nil {
+		return fmt.Errorf("backing up the previous index: %v", err)
+	}
+	// 6, 4, 4 -> oox, oxx, oxx
+	if err := writeFileAtomic(indexPath, data, 0644); err != nil {
+		return err
+	}
+	index.path = indexPath
+	return writeChecksum(indexPath, data)
+}
+
+// backupFile holds the previous generation of the index, for 'restore'
+func backupFile(indexPath string) string {
+	return indexPath + ".bak"
+}
+
+// backupIndex copies the index about to be replaced to its backup file.
+// It is copied rather than renamed so an index stays in place even if the
+// save that follows is interrupted.
+func backupIndex(indexPath string) error {
+	data, err := os.ReadFile(indexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(backupFile(indexPath), data, 0644); err != nil {
+		return err
+	}
+	return writeChecksum(backupFile(indexPath), data)
+}
+
+// restoreIndex swaps the index and its backup, so restoring twice gets
+// back to where it started. The backup is checked to decode first, so a
+// damaged backup never replaces the index.
+func restoreIndex(indexPath string) error {
+	backup, err := os.ReadFile(backupFile(indexPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no backup of %s yet; one is kept from the next save", indexPath)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := loadIndex(backupFile(indexPath)); err != nil {
+		return fmt.Errorf("the backup can't be used: %v", err)
+	}
+
+	current, err := os.ReadFile(indexPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := writeFileAtomic(indexPath, backup, 0644); err != nil {
+		return err
+	}
+	if err := writeChecksum(indexPath, backup); err != nil {
+		return err
+	}
+	if current == nil {
+		return os.Remove(backupFile(indexPath))
+	}
+	if err := writeFileAtomic(backupFile(indexPath), current, 0644); err != nil {
+		return err
+	}
+	return writeChecksum(backupFile(indexPath), current)
+}
+
+// restoreBackup puts the previous index back in place and logs which
+// comics that brought back or dropped
+func restoreBackup(store Store) error {
+	// The current index may well be why the user is restoring, so it not
+	// loading only means the change can't be logged
+	before, loadErr := store.Load()
+
+	if err := store.Restore(); err != nil {
+		return err
+	}
+	after, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored the previous index: %d comics, up to #%d\n", len(after.Comics), after.LastNum)
+	fmt.Println("The replaced index is now the backup; run 'restore' again to undo.")
+
+	if loadErr == nil {
+		var added, removed []int
+		for num := range after.Comics {
+			if _, exists := before.Comics[num]; !exists {
+				added = append(added, num)
+			}
+		}
+		for num := range before.Comics {
+			if _, exists := after.Comics[num]; !exists {
+				removed = append(removed, num)
+			}
+		}
+		slices.Sort(added)
+		slices.Sort(removed)
+		recordAudit(store, "restore", added, nil, removed, after.LastNum)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it over path, so a crash mid-write leaves either the old
+// file or the new one, never a truncated mix
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Removing fails harmlessly once the rename has succeeded
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Flush to disk before the rename makes the new contents visible
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// checksumFile is the companion file holding the SHA-256 of the index,
+// in the same "<hash>  <name>" format sha256sum uses
+func checksumFile(indexPath string) string {
+	return indexPath + ".sha256"
+}
+
+func checksum(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func writeChecksum(indexPath string, data []byte) error {
+	line := fmt.Sprintf("%s  %s\n", checksum(data), filepath.Base(indexPath))
+	return writeFileAtomic(checksumFile(indexPath), []byte(line), 0644)
+}
+
+// readChecksum returns the stored hash, or "" if none has been recorded yet
+func readChecksum(indexPath string) (string, error) {
+	data, err := os.ReadFile(checksumFile(indexPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum file %s is empty", checksumFile(indexPath))
+	}
+	return fields[0], nil
+}
+
+func verifyIndexChecksum(indexPath string) error {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+
+	stored, err := readChecksum(indexPath)
+	if err != nil {
+		return err
+	}
+
+	computed := checksum(data)
+	fmt.Printf("Index file: %s\n", indexPath)
+	fmt.Printf("Stored:     %s\n", valueOr(stored, "(none recorded)"))
+	fmt.Printf("Computed:   %s\n", computed)
+
+	switch {
+	case stored == "":
+		fmt.Println("No checksum recorded yet; one is written on the next save.")
+	case stored != computed:
+		return fmt.Errorf("checksum mismatch: the index may be corrupt or modified")
+	default:
+		fmt.Println("Checksum OK.")
+	}
+	return nil
+}
+
+// backfill fetches only the comics missing between 1 and LastNum, filling
+// the holes left by interrupted updates without rescanning the archive.
+// Numbers that don't exist upstream are recorded as absent and skipped
+// from then on.
+func backfill(ctx context.Context, store Store, f *fetcher, opts updateOptions) error {
+	index, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load index: %v", err)
+	}
+
+	missing := missingNums(index)
+	if len(missing) == 0 {
+		infof("No missing comics to backfill.\n")
+		return nil
+	}
+
+	infof("Filling %d holes (%s) with %d workers...\n", len(missing), formatNums(missing), opts.workers)
+	fetched, added, _ := fetchInto(ctx, store, index, f, missing, opts, "backfill")
+	if fetched == 0 {
+		infof("No comics could be fetched.\n")
+		return nil
+	}
+
+	index.Updated = time.Now()
+	debugf("Saving index with %d comics...\n", len(index.Comics))
+	if err := store.Save(index); err != nil {
+		return fmt.Errorf("failed to save index: %v", err)
+	}
+	recordAudit(store, "backfill", added, nil, nil, index.LastNum)
+
+	if ctx.Err() != nil {
+		infof("Interrupted: saved %d backfilled comics; run 'backfill' again to continue.\n", fetched)
+		return nil
+	}
+	infof("Backfilled %d of %d missing comics.\n", fetched, len(missing))
+	return nil
+}
+
+// missingNums lists, in order, the comic numbers between 1 and LastNum
+// that are not in the index and not known to be absent
+func missingNums(index *Index) []int {
+	var missing []int
+	for num := 1; num <= index.LastNum; num++ {
+		if _, exists := index.Comics[num]; !exists && !index.isAbsent(num) {
+			missing = append(missing, num)
+		}
+	}
+	return missing
+}
+
+// verifyIndex checks that the index parses, that every entry holds a comic
+// with its required fields, and that no numbers up to LastNum are missing.
+// Loading already fails with a clear message on a corrupt file.
+func verifyIndex(w io.Writer, store Store) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var empty, incomplete []int
+	for num, comic := range index.Comics {
+		switch {
+		case comic == nil:
+			empty = append(empty, num)
+		case !complete(comic):
+			incomplete = append(incomplete, num)
+		}
+	}
+	sort.Ints(empty)
+	sort.Ints(incomplete)
+	missing := missingNums(index)
+
+	fmt.Fprintf(w, "Comics:      %d\n", len(index.Comics))
+	fmt.Fprintf(w, "Last number: %d\n", index.LastNum)
+	fmt.Fprintf(w, "Missing:     %s\n", valueOr(formatNums(missing), "none"))
+	var absent []int
+	for num := 1; num <= index.LastNum; num++ {
+		if _, exists := index.Comics[num]; !exists && index.isAbsent(num) {
+			absent = append(absent, num)
+		}
+	}
+	if len(absent) > 0 {
+		fmt.Fprintf(w, "Absent:      %s (never published)\n", formatNums(absent))
+	}
+	if len(empty) > 0 {
+		fmt.Fprintf(w, "Empty:       %s\n", formatNums(empty))
+	}
+	if len(incomplete) > 0 {
+		fmt.Fprintf(w, "Incomplete:  %s (no number, title or image)\n", formatNums(incomplete))
+	}
+
+	if problems := len(missing) + len(empty) + len(incomplete); problems > 0 {
+		return fmt.Errorf("found %d problems in the index; run 'backfill' to fetch missing comics", problems)
+	}
+	fmt.Fprintln(w, "Index OK.")
+	return nil
+}
+
+// pruneFilter selects the comics prune keeps: those within the number
+// range and not known to be outside the date range
+type pruneFilter struct {
+	from, to int	// Inclusive comic numbers; 0 leaves that end open
+	dates    dateRange
+}
+
+// parseKeepRange reads a -keep range of comic numbers: "2000-", "-500",
+// "100-200" or a single number
+func parseKeepRange(spec string) (from, to int, err error) {
+	lo, hi, isRange := strings.Cut(spec, "-")
+	if !isRange {
+		hi = lo
+	}
+	if lo != "" {
+		if from, err = strconv.Atoi(lo); err != nil || from < 1 {
+			return 0, 0, fmt.Errorf("invalid -keep range %q (use e.g. 2000-, -500 or 100-200)", spec)
+		}
+	}
+	if hi != "" {
+		if to, err = strconv.Atoi(hi); err != nil || to < max(from, 1) {
+			return 0, 0, fmt.Errorf("invalid -keep range %q (use e.g. 2000-, -500 or 100-200)", spec)
+		}
+	}
+	return from, to, nil
+}
+
+func (p pruneFilter) active() bool {
+	return p.from > 0 || p.to > 0 || p.dates.active()
+}
+
+// keeps reports whether the comic stays in the index. A comic without a
+// valid date is only pruned by number, never by date.
+func (p pruneFilter) keeps(num int, comic *Comic) bool {
+	if (p.from > 0 && num < p.from) || (p.to > 0 && num > p.to) {
+		return false
+	}
+	if comic == nil || !p.dates.active() {
+		return true
+	}
+	if _, err := comic.Date(); err != nil {
+		return true
+	}
+	return p.dates.contains(comic)
+}
+
+// pruneIndex removes the comics the filter doesn't keep. If the newest
+// comics are pruned, LastNum drops to the newest one left, so a later
+// update fetches them again; comics pruned below it stay gone.
+func pruneIndex(store Store, filter pruneFilter, dryRun bool) error {
+	if !filter.active() {
+		return fmt.Errorf("nothing to prune by; use -keep, -before or -after")
+	}
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var removed []int
+	newest := 0
+	for num, comic := range index.Comics {
+		if filter.keeps(num, comic) {
+			newest = max(newest, num)
+		} else {
+			removed = append(removed, num)
+		}
+	}
+	sort.Ints(removed)
+
+	if len(removed) == 0 {
+		fmt.Println("Nothing to prune.")
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("Would remove %d comics, keeping %d: %s\n", len(removed), len(index.Comics)-len(removed), formatNums(removed))
+		return nil
+	}
+
+	for _, num := range removed {
+		delete(index.Comics, num)
+		delete(index.Validators, num)
+	}
+	if removed[len(removed)-1] > newest {
+		index.LastNum = newest
+	}
+	if err := store.Save(index); err != nil {
+		return fmt.Errorf("failed to save index: %v", err)
+	}
+	recordAudit(store, "prune", nil, nil, removed, index.LastNum)
+
+	fmt.Printf("Removed %d comics: %s\n", len(removed), formatNums(removed))
+	fmt.Printf("%d comics left, up to #%d\n", len(index.Comics), index.LastNum)
+	return nil
+}
+
+// mergeIndex adds the comics of another index file to the store's index.
+// Comics already indexed are kept, unless the indexed copy is incomplete
+// and the other one isn't.
+func mergeIndex(store Store, otherPath string) error {
+	other, err := loadExistingIndex(otherPath)
+	if err != nil {
+		return err
+	}
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var added, updated []int
+	present, newest := 0, 0
+	for num, comic := range other.Comics {
+		if comic == nil {
+			continue
+		}
+		newest = max(newest, num)
+		existing, exists := index.Comics[num]
+		switch {
+		case !exists:
+			index.Comics[num] = comic
+			added = append(added, num)
+		case !complete(existing) && complete(comic):
+			index.Comics[num] = comic
+			updated = append(updated, num)
+		default:
+			present++
+		}
+	}
+	sort.Ints(added)
+	sort.Ints(updated)
+	for _, num := range other.Absent {
+		if _, exists := index.Comics[num]; !exists {
+			index.markAbsent(num)
+		}
+	}
+
+	if len(added) == 0 && len(updated) == 0 {
+		fmt.Printf("Nothing to merge: all %d comics in %s are already indexed.\n", present, otherPath)
+		return nil
+	}
+
+	index.LastNum = contiguousLastNum(index, newest)
+	if other.Updated.After(index.Updated) {
+		index.Updated = other.Updated
+	}
+	if err := store.Save(index); err != nil {
+		return fmt.Errorf("failed to save index: %v", err)
+	}
+	recordAudit(store, "merge", added, updated, nil, index.LastNum)
+
+	fmt.Printf("Merged %s: %d comics added, %d already present", otherPath, len(added), present)
+	if len(updated) > 0 {
+		fmt.Printf(", %d incomplete ones replaced", len(updated))
+	}
+	fmt.Printf("\n%d comics indexed, up to #%d\n", len(index.Comics), index.LastNum)
+	return nil
+}
+
+// importArchive adds the comics of a directory of info.0.json files, such
+// as a bulk archive of xkcd.com's JSON, without going online. Files are
+// found in subdirectories too (e.g. 353/info.0.json). Like merge, it keeps
+// the comics already indexed unless their copy is incomplete. Files that
+// aren't a comic are skipped with a warning.
+func importArchive(store Store, dir string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var added, updated []int
+	present, skipped, newest := 0, 0, 0
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		comic, err := readComicFile(path)
+		if err != nil {
+			warnf("skipping %s: %v\n", path, err)
+			skipped++
+			return nil
+		}
+
+		num := comic.Num
+		newest = max(newest, num)
+		existing, exists := index.Comics[num]
+		switch {
+		case !exists:
+			index.Comics[num] = comic
+			added = append(added, num)
+		case !complete(existing) && complete(comic):
+			index.Comics[num] = comic
+			updated = append(updated, num)
+		default:
+			present++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Ints(added)
+	sort.Ints(updated)
+
+	if len(added) == 0 && len(updated) == 0 {
+		infof("Nothing to import: %d comics in %s are already indexed, %d files skipped.\n", present, dir, skipped)
+		return nil
+	}
+
+	index.LastNum = contiguousLastNum(index, newest)
+	index.Updated = time.Now()
+	if err := store.Save(index); err != nil {
+		return fmt.Errorf("failed to save index: %v", err)
+	}
+	recordAudit(store, "import", added, updated, nil, index.LastNum)
+
+	summary := fmt.Sprintf("Imported %s: %d comics added, %d already present", dir, len(added), present)
+	if len(updated) > 0 {
+		summary += fmt.Sprintf(", %d incomplete ones replaced", len(updated))
+	}
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d files skipped", skipped)
+	}
+	infof("%s\n%d comics indexed, up to #%d\n", summary, len(index.Comics), index.LastNum)
+	return nil
+}
+
+// readComicFile decodes one info.0.json file of an archive
+func readComicFile(path string) (*Comic, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	comic, err := decodeComic(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if comic.Num <= 0 {
+		return nil, fmt.Errorf("no comic number")
+	}
+	return comic, nil
+}
+
+// IndexDiff lists what changed between two indexes
+type IndexDiff struct {
+	Added   []*Comic      `json:"added"`
+	Removed []*Comic      `json:"removed"`
+	Changed []ComicChange `json:"changed"`
+}
+
+// ComicChange is a comic present in both indexes with different fields
+type ComicChange struct {
+	Num    int           `json:"num"`
+	Title  string        `json:"title"`	// From the newer index
+	Fields []FieldChange `json:"fields"`
+}
+
+// FieldChange is one edited field, named as in the JSON API
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// comicFields lists the comparable fields of a comic by their JSON names
+var comicFields = []struct {
+	name  string
+	value func(c *Comic) string
+}{
+	{"title", func(c *Comic) string { return c.Title }},
+	{"safe_title", func(c *Comic) string { return c.SafeTitle }},
+	{"year", func(c *Comic) string { return c.Year }},
+	{"month", func(c *Comic) string { return c.Month }},
+	{"day", func(c *Comic) string { return c.Day }},
+	{"alt", func(c *Comic) string { return c.Alt }},
+	{"transcript", func(c *Comic) string { return c.Transcript }},
+	{"img", func(c *Comic) string { return c.Img }},
+	{"link", func(c *Comic) string { return c.Link }},
+	{"interactive", func(c *Comic) string { return strconv.FormatBool(c.Interactive) }},
+}
+
+// diffIndexes compares two indexes comic by comic, in number order
+func diffIndexes(old, new *Index) IndexDiff {
+	var d IndexDiff
+	for _, num := range slices.Sorted(maps.Keys(new.Comics)) {
+		comic := new.Comics[num]
+		previous, exists := old.Comics[num]
+		if !exists || previous == nil {
+			d.Added = append(d.Added, comic)
+			continue
+		}
+		var fields []FieldChange
+		for _, field := range comicFields {
+			if before, after := field.value(previous), field.value(comic); before != after {
+				fields = append(fields, FieldChange{Field: field.name, Old: before, New: after})
+			}
+		}
+		if len(fields) > 0 {
+			d.Changed = append(d.Changed, ComicChange{Num: num, Title: comic.Title, Fields: fields})
+		}
+	}
+	for _, num := range slices.Sorted(maps.Keys(old.Comics)) {
+		if _, exists := new.Comics[num]; !exists && old.Comics[num] != nil {
+			d.Removed = append(d.Removed, old.Comics[num])
+		}
+	}
+	return d
+}
+
+// diffIndexFiles compares the index at oldPath with the one at newPath,
+// or with the store's index when newPath is empty
+func diffIndexFiles(w io.Writer, store Store, oldPath, newPath string) error {
+	old, err := loadExistingIndex(oldPath)
+	if err != nil {
+		return err
+	}
+	var new *Index
+	if newPath == "" {
+		new, err = store.Load()
+	} else {
+		new, err = loadExistingIndex(newPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	d := diffIndexes(old, new)
+	if *jsonFlag {
+		return printJSON(w, d)
+	}
+	return printDiff(w, d)
+}
+
+// loadExistingIndex loads an index the user named. loadIndex treats a
+// missing file as an empty index, which would turn a mistyped path into
+// "every comic was added".
+func loadExistingIndex(path string) (*Index, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return loadIndex(path)
+}
+
+// printDiff writes additions and removals as one line per comic, and
+// edits with the old and new value of each changed field
+func printDiff(w io.Writer, d IndexDiff) error {
+	if len(d.Added)+len(d.Removed)+len(d.Changed) == 0 {
+		fmt.Fprintln(w, "No differences.")
+		return nil
+	}
+
+	for _, comic := range d.Added {
+		fmt.Fprintf(w, "+ #%d: %s\n", comic.Num, comic.Title)
+	}
+	for _, comic := range d.Removed {
+		fmt.Fprintf(w, "- #%d: %s\n", comic.Num, comic.Title)
+	}
+	for _, change := range d.Changed {
+		fmt.Fprintf(w, "~ #%d: %s\n", change.Num, change.Title)
+		for _, field := range change.Fields {
+			fmt.Fprintf(w, "    %s:\n", field.Field)
+			for _, line := range strings.Split(field.Old, "\n") {
+				fmt.Fprintf(w, "      - %s\n", line)
+			}
+			for _, line := range strings.Split(field.New, "\n") {
+				fmt.Fprintf(w, "      + %s\n", line)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+	return nil
+}
+
+// complete reports whether a comic has the fields verify requires
+func complete(comic *Comic) bool {
+	return comic != nil && comic.Num != 0 && comic.Title != "" && comic.Img != ""
+}
+
+func valueOr(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// updateOptions holds the flags of the update command
+type updateOptions struct {
+	workers       int			// Number of concurrent fetchComic calls
+	checkInterval time.Duration	// Skip the latest-comic lookup if the last one is more recent
+	force         bool			// Look up the latest comic regardless of checkInterval
+	refreshLast   int			// Fetch the newest comics again even if indexed
+	progress      progressMode	// How fetchInto reports progress
+	dryRun        bool			// Print what would be fetched and stop
+	maxNew        int			// Fetch at most this many new comics (0 = all)
+	transcripts   bool			// Look up missing transcripts on explainxkcd
+	onNew         string		// Command run for each added comic
+}
+
+// fetchResult is the outcome of fetching one comic in a worker
+type fetchResult struct {
+	num       int
+	comic     *Comic
+	validator Validator
+	err       error
+}
+
+// fetchAll fetches the given comics with a pool of workers and streams the
+// results back in completion order. Comics with an entry in validators
+// are fetched conditionally. The channel is closed once every comic has
+// been attempted, or early once ctx is canceled.
+func (f *fetcher) fetchAll(ctx context.Context, nums []int, workers int, validators map[int]Validator) <-chan fetchResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan fetchResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for num := range jobs {
+				comic, validator, err := f.fetchComicIfChanged(ctx, num, validators[num])
+				results <- fetchResult{num: num, comic: comic, validator: validator, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, num := range nums {
+			select {
+			case jobs <- num:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// updateIndex fetches the comics published since the last update and
+// returns the ones it added, in order. If ctx is canceled it stops early
+// and still saves what it has fetched.
+func updateIndex(ctx context.Context, store Store, f *fetcher, opts updateOptions) ([]*Comic, error) {
+	debugf("Loading existing index...\n")
+	index, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load index: %v", err)
+	}
+
+	// A frequent cron job needn't ask xkcd.com every time: new comics
+	// appear a few times a week
+	if since := time.Since(index.Checked); !opts.force && !opts.dryRun && !opts.transcripts && opts.refreshLast == 0 && since < opts.checkInterval {
+		infof("Index is up to date (checked %v ago; use -force to check now).\n", since.Round(time.Second))
+		return nil, nil
+	}
+
+	debugf("Fetching latest comic to determine range...\n")
+	latest, err := f.fetchComic(ctx, 0)	// Fetch LATEST comic, return *Comic
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch latest comic: %v", err)
+	}
+	checked := time.Now()
+
+	infof("Latest comic: #%d - %s\n", latest.Num, latest.Title)
+
+	toFetch, previous := planUpdate(index, latest.Num, opts.refreshLast)
+	toFetch, deferred := limitNew(toFetch, previous, opts.maxNew)
+	totalToFetch := len(toFetch)
+	if opts.dryRun {
+		printUpdatePlan(os.Stdout, toFetch, len(previous), f.rate, opts.workers)
+		if deferred > 0 {
+			fmt.Printf("Leaves %d comics for later runs (-max %d)\n", deferred, opts.maxNew)
+		}
+		if opts.transcripts {
+			fmt.Printf("Would look up %d missing transcripts on explainxkcd, plus those of new comics without one\n", len(missingTranscripts(index)))
+		}
+		return nil, nil
+	}
+
+	if totalToFetch == 0 && index.LastNum == latest.Num && !opts.transcripts {
+		// Save only to remember when this check happened
+		index.Checked = checked
+		if err := store.Save(index); err != nil {
+			return nil, fmt.Errorf("failed to save index: %v", err)
+		}
+		infof("Index is already up to date.\n")
+		return nil, nil
+	}
+
+	if totalToFetch > 0 {
+		infof("Need to fetch %d comics with %d workers...\n", totalToFetch, opts.workers)
+	}
+	if len(previous) > 0 {
+		infof("Refreshing the %d newest indexed comics\n", len(previous))
+	}
+
+	fetched, added, updated := fetchInto(ctx, store, index, f, toFetch, opts, "update")
+	var filled []int
+	if opts.transcripts && ctx.Err() == nil {
+		filled = fillTranscripts(ctx, index, f, opts)
+		for _, num := range filled {
+			if !slices.Contains(added, num) && !slices.Contains(updated, num) {
+				updated = append(updated, num)
+			}
+		}
+	}
+	// Comics past the last one fetched were already indexed by an earlier run
+	index.LastNum = contiguousLastNum(index, latest.Num)
+	if index.LastNum < latest.Num && ctx.Err() == nil && deferred == 0 {
+		warnf("comics after #%d could not all be fetched; the next update retries them\n", index.LastNum)
+	}
+	if index.LastNum == latest.Num {
+		index.Checked = checked		// Complete, so later updates may skip the check
+	}
+	index.Updated = time.Now()
+
+	debugf("Saving index with %d comics...\n", len(index.Comics))
+	if err := store.Save(index); err != nil {
+		return nil, fmt.Errorf("failed to save index: %v", err)
+	}
+	recordAudit(store, "update", added, updated, nil, index.LastNum)
+
+	var newComics []*Comic
+	for _, num := range toFetch {
+		if _, refreshed := previous[num]; !refreshed && index.Comics[num] != nil {
+			newComics = append(newComics, index.Comics[num])
+		}
+	}
+
+	// fetched also counts the refreshed comics, changed or not. A refreshed
+	// comic has been replaced by a new value; a failed one hasn't.
+	var changed []int
+	for num, before := range previous {
+		if after := index.Comics[num]; after != before {
+			fetched--
+			if *after != *before {
+				changed = append(changed, num)
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		infof("Interrupted: saved %d new comics; run 'update' again to continue.\n", fetched)
+		return newComics, nil
+	}
+	// Cache the new comics' words now, rather than in the next search
+	if fetched > 0 {
+		index.searchWords()
+	}
+	runHooks(ctx, opts.onNew, newComics)
+	infof("Successfully updated index! Fetched %d new comics.\n", fetched)
+	if opts.transcripts {
+		infof("Added %d transcripts from explainxkcd.\n", len(filled))
+	}
+	if len(previous) > 0 {
+		infof("Refreshed %d comics; changed: %s\n", len(previous), valueOr(formatNums(changed), "none"))
+	}
+	if deferred > 0 {
+		infof("Stopped at -max %d: %d comics remain; run 'update' again to continue.\n", opts.maxNew, deferred)
+	}
+	return newComics, nil
+}
+
+// runHooks runs the -on-new command once for each new comic, with the
+// comic's number and title as arguments and in $XKCD_NUM, $XKCD_TITLE and
+// $XKCD_URL. The command goes through the shell, so it may use pipes and
+// quoting. A failing hook only warns: the comics are already saved.
+func runHooks(ctx context.Context, command string, comics []*Comic) {
+	if command == "" {
+		return
+	}
+	for _, comic := range comics {
+		num := strconv.Itoa(comic.Num)
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command, num, comic.Title)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command+` "$@"`, "sh", num, comic.Title)
+		}
+		cmd.Env = append(os.Environ(),
+			"XKCD_NUM="+num,
+			"XKCD_TITLE="+comic.Title,
+			"XKCD_URL="+comicURL(comic.Num),
+		)
+		// Keep stdout for the command's own output
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		debugf("Running -on-new for comic #%d\n", comic.Num)
+		if err := cmd.Run(); err != nil && ctx.Err() == nil {
+			warnf("-on-new command failed for comic #%d: %v\n", comic.Num, err)
+		}
+	}
+}
+
+// watch checks for new comics every interval until ctx is canceled,
+// adding them to the index like update and showing each one as it
+// arrives. A failed check only warns; the next one tries again.
+func watch(ctx context.Context, store Store, f *fetcher, opts updateOptions, interval time.Duration, show showOptions) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	// Otherwise the first check would download and show the whole archive
+	if len(index.Comics) == 0 {
+		return fmt.Errorf("the index is empty; run 'update' first")
+	}
+
+	infof("Watching for new comics every %v; press Ctrl+C to stop.\n", interval)
+	opts.force = true
+	for {
+		newComics, err := updateIndex(ctx, store, f, opts)
+		if err != nil && ctx.Err() == nil {
+			warnf("%v\n", err)
+		}
+		for _, comic := range newComics {
+			if show.image && comic.Img != "" && cachedImage(comic) == "" {
+				if _, err := f.fetchImage(ctx, comic); err != nil && ctx.Err() == nil {
+					warnf("failed to fetch image for comic #%d: %v\n", comic.Num, err)
+				}
+			}
+			fmt.Fprintln(show.out, colorize("New comic!", ansiBold))
+			if err := show.display(comic); err != nil {
+				return err
+			}
+			fmt.Fprintln(show.out)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// planUpdate lists the comics an update up to latest fetches: those after
+// the last indexed one, and with refreshLast the newest indexed comics
+// again, which are also returned by number so their changes can be told
+func planUpdate(index *Index, latest, refreshLast int) (toFetch []int, previous map[int]*Comic) {
+	// Confirm the range to be downloaded
+	startNum := 1
+	if index.LastNum > 0 {
+		startNum = index.LastNum + 1
+	}
+
+	// Comics already indexed are only fetched again with -refresh-last, to
+	// pick up alt text or transcripts edited after publishing
+	refreshFrom := latest - refreshLast + 1
+	previous = make(map[int]*Comic)
+	for i := 1; i <= latest; i++ {
+		comic, exist := index.Comics[i]	// map access return val and bool
+		switch {
+		case exist && i >= refreshFrom:
+			previous[i] = comic
+			toFetch = append(toFetch, i)
+		case !exist && i >= startNum && !index.isAbsent(i):
+			toFetch = append(toFetch, i)
+		}
+	}
+	return toFetch, previous
+}
+
+// limitNew keeps at most max of the comics in toFetch that aren't in
+// previous (the ones being refreshed), the lowest numbers first, so that
+// the next run continues right after them. It returns how many new
+// comics were left out; limit 0 keeps them all.
+func limitNew(toFetch []int, previous map[int]*Comic, limit int) (limited []int, deferred int) {
+	if limit <= 0 {
+		return toFetch, 0
+	}
+	kept := 0
+	for _, num := range toFetch {
+		if _, refresh := previous[num]; refresh {
+			limited = append(limited, num)
+		} else if kept < limit {
+			limited = append(limited, num)
+			kept++
+		} else {
+			deferred++
+		}
+	}
+	return limited, deferred
+}
+
+// printUpdatePlan describes what update -dry-run would fetch, with the
+// least time it could take at rate requests per second (0 = unlimited)
+func printUpdatePlan(w io.Writer, toFetch []int, refreshed int, rate float64, workers int) {
+	if len(toFetch) == 0 {
+		fmt.Fprintln(w, "Nothing to fetch: the index is up to date.")
+		return
+	}
+	fmt.Fprintf(w, "Would fetch %d comics: %s\n", len(toFetch), formatNums(toFetch))
+	fmt.Fprintf(w, "First: #%d, last: #%d\n", toFetch[0], toFetch[len(toFetch)-1])
+	if refreshed > 0 {
+		fmt.Fprintf(w, "Including %d indexed comics to refresh\n", refreshed)
+	}
+	if rate > 0 {
+		estimate := time.Duration(float64(len(toFetch)) / rate * float64(time.Second))
+		fmt.Fprintf(w, "Takes at least %v at %g requests/second with %d workers\n", estimate.Round(100*time.Millisecond), rate, workers)
+	}
+}
+
+// fetchInto downloads the given comics into index, saving progress every
+// 50 comics and auditing each save under command. LastNum advances only
+// over the contiguous run of comics that are indexed (or confirmed not to
+// exist), so a failed fetch in the middle is retried by the next update.
+// It returns how many were fetched and the comics added or changed since
+// the last audited save; the caller makes the final save and audits those.
+func fetchInto(ctx context.Context, store Store, index *Index, f *fetcher, nums []int, opts updateOptions, command string) (fetched int, added, updated []int) {
+	p := newProgress(opts.progress, len(nums))
+	defer p.finish()
+	limit := 0
+	for _, num := range nums {
+		limit = max(limit, num)
+	}
+	defer func() {
+		index.LastNum = contiguousLastNum(index, limit)
+	}()
+
+	// Comics already indexed are refetched conditionally. The workers get
+	// a copy of their validators, since this goroutine updates the index's
+	validators := make(map[int]Validator)
+	for _, num := range nums {
+		if v, ok := index.Validators[num]; ok && index.Comics[num] != nil {
+			validators[num] = v
+		}
+	}
+	if index.Validators == nil {
+		index.Validators = make(map[int]Validator)
+	}
+
+	// Download the missing comics. Workers only fetch; this goroutine is the
+	// single writer of index.Comics, so the map needs no locking
+	results := f.fetchAll(ctx, nums, opts.workers, validators)
+
+	for res := range results {
+		if res.err != nil && ctx.Err() != nil {
+			continue	// Canceled, not failed; no need to warn about each one
+		}
+		if errors.Is(res.err, ErrNotModified) {
+			p.step(fmt.Sprintf("Comic #%d unchanged", res.num))
+			continue
+		}
+		if res.err != nil {
+			if errors.Is(res.err, ErrComicNotFound) {
+				// Not a failure: the number was skipped, so remember it
+				// instead of retrying it every run
+				index.markAbsent(res.num)
+				p.step(fmt.Sprintf("Comic #%d does not exist; skipping it from now on", res.num))
+				continue
+			}
+			p.warnf("failed to fetch comic #%d: %v\n", res.num, res.err)
+			p.step("")
+			continue
+		}
+
+		if res.comic == nil {
+			p.warnf("comic #%d does not exist\n", res.num)
+			p.step("")
+			continue
+		}
+
+		// xkcd.com doesn't have the transcripts taken from explainxkcd, so
+		// a refetch keeps them
+		if old, exists := index.Comics[res.num]; exists && res.comic.Transcript == "" && index.hasWikiTranscript(res.num) {
+			res.comic.Transcript = old.Transcript
+		}
+
+		// A comic fetched again is only an update if xkcd.com changed it
+		if old, exists := index.Comics[res.num]; !exists {
+			added = append(added, res.num)
+		} else if *old != *res.comic {
+			updated = append(updated, res.num)
+		}
+		index.Comics[res.num] = res.comic
+		if res.validator != (Validator{}) {
+			index.Validators[res.num] = res.validator
+		} else {
+			delete(index.Validators, res.num)
+		}
+		fetched++
+		p.step(fmt.Sprintf("Fetched comic #%d", res.num))
+
+		// Save progress every 50 comics to prevent data loss. Results arrive
+		// out of order, so the checkpoint only records the contiguous prefix:
+		// a resumed update rescans from there and skips what is indexed
+		if fetched%50 == 0 {
+			debugf("Saving progress... (%d/%d)\n", fetched, p.total)
+			index.LastNum = contiguousLastNum(index, limit)
+			index.Updated = time.Now()		// Update updated time
+			if err := store.Save(index); err != nil {
+				p.warnf("failed to save progress: %v\n", err)
+			} else {
+				recordAudit(store, command, added, updated, nil, index.LastNum)
+				added, updated = nil, nil
+			}
+		}
+	}
+	return fetched, added, updated
+}
+
+// missingTranscripts lists the indexed comics without a transcript, in order
+func missingTranscripts(index *Index) []int {
+	var nums []int
+	for num, comic := range index.Comics {
+		if strings.TrimSpace(comic.Transcript) == "" {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// fillTranscripts looks up the comics without a transcript on explainxkcd
+// with a pool of workers, stores the transcripts it finds in the index
+// and returns those comics. Comics the wiki hasn't transcribed yet are
+// looked up again next time.
+func fillTranscripts(ctx context.Context, index *Index, f *fetcher, opts updateOptions) (filled []int) {
+	nums := missingTranscripts(index)
+	if len(nums) == 0 {
+		return nil
+	}
+	infof("Looking up %d missing transcripts on explainxkcd...\n", len(nums))
+	p := newProgress(opts.progress, len(nums))
+	defer p.finish()
+
+	type result struct {
+		num        int
+		transcript string
+		err        error
+	}
+	jobs := make(chan int)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, opts.workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for num := range jobs {
+				transcript, err := f.fetchTranscript(ctx, num)
+				results <- result{num: num, transcript: transcript, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, num := range nums {
+			select {
+			case jobs <- num:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// As in fetchInto, only this goroutine writes to the index
+	for res := range results {
+		switch {
+		case res.err != nil && ctx.Err() != nil:
+		case res.err != nil:
+			p.warnf("failed to fetch the transcript of comic #%d: %v\n", res.num, res.err)
+			p.step("")
+		case res.transcript == "":
+			p.step(fmt.Sprintf("No transcript of comic #%d yet", res.num))
+		default:
+			index.Comics[res.num].Transcript = res.transcript
+			index.markWikiTranscript(res.num)
+			filled = append(filled, res.num)
+			p.step(fmt.Sprintf("Fetched the transcript of comic #%d", res.num))
+		}
+	}
+	sort.Ints(filled)
+	return filled
+}
+
+// progressModes are the values of -progress. auto draws a bar on a
+// terminal and prints summary lines otherwise.
+var progressModes = []string{"auto", "bar", "verbose", "summary"}
+
+// progressMode is a -progress flag value, checked against progressModes
+type progressMode string
+
+func (m *progressMode) String() string {
+	return string(*m)
+}
+
+func (m *progressMode) Set(s string) error {
+	if !slices.Contains(progressModes, s) {
+		return fmt.Errorf("unknown progress mode %q (use %s)", s, strings.Join(progressModes, ", "))
+	}
+	*m = progressMode(s)
+	return nil
+}
+
+// progressBarWidth is the number of cells in the progress bar
+const progressBarWidth = 30
+
+// progress reports how far a download has got: a bar redrawn in place,
+// a line per item, or a summary line about every tenth of the way
+type progress struct {
+	mode  progressMode
+	total int
+	done  int
+	start time.Time
+	drawn bool	// The bar is on the current line
+}
+
+// newProgress resolves auto to a line per item with -v, else a bar when
+// stderr is a terminal. -q turns progress off whatever the mode.
+func newProgress(mode progressMode, total int) *progress {
+	switch {
+	case verbosity == levelQuiet:
+		mode = "off"
+	case mode != "" && mode != "auto":
+	case verbosity == levelVerbose:
+		mode = "verbose"
+	case isTerminal(os.Stderr):
+		mode = "bar"
+	default:
+		mode = "summary"
+	}
+	return &progress{mode: mode, total: total, start: time.Now()}
+}
+
+// step counts one item as finished, successfully or not. label describes
+// it in verbose mode; failures pass "" since they were already reported.
+func (p *progress) step(label string) {
+	p.done++
+	switch p.mode {
+	case "verbose":
+		if label != "" {
+			infof("%s (%d/%d)\n", label, p.done, p.total)
+		}
+	case "bar":
+		p.draw()
+	case "summary":
+		if p.done == p.total || p.done*10/p.total != (p.done-1)*10/p.total {
+			infof("Progress: %d/%d (%d%%)%s\n", p.done, p.total, p.percent(), p.eta())
+		}
+	}
+}
+
+func (p *progress) percent() int {
+	if p.total == 0 {
+		return 100
+	}
+	return p.done * 100 / p.total
+}
+
+// eta extrapolates the time left from the average time per item so far
+func (p *progress) eta() string {
+	if p.done == 0 || p.done >= p.total {
+		return ""
+	}
+	left := time.Since(p.start) / time.Duration(p.done) * time.Duration(p.total-p.done)
+	return fmt.Sprintf(", ETA %v", left.Round(time.Second))
+}
+
+// draw redraws the bar over the current line
+func (p *progress) draw() {
+	filled := progressBarWidth * p.percent() / 100
+	fmt.Fprintf(os.Stderr, "\r\033[K[%s%s] %3d%% %d/%d%s",
+		strings.Repeat("█", filled), strings.Repeat("░", progressBarWidth-filled),
+		p.percent(), p.done, p.total, p.eta())
+	p.drawn = true
+}
+
+// warnf prints a warning above the bar
+func (p *progress) warnf(format string, args ...any) {
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	warnf(format, args...)
+	if p.drawn {
+		p.draw()
+	}
+}
+
+// finish ends the bar's line, so the output that follows starts on its own
+func (p *progress) finish() {
+	if p.drawn {
+		fmt.Fprintln(os.Stderr)
+		p.drawn = false
+	}
+}
+
+// contiguousLastNum extends index.LastNum over the following comics, up to
+// limit, as long as each is indexed or known to be absent. It never moves
+// LastNum backwards.
+func contiguousLastNum(index *Index, limit int) int {
+	last := index.LastNum
+	for last < limit {
+		if _, exists := index.Comics[last+1]; !exists && !index.isAbsent(last+1) {
+			break
+		}
+		last++
+	}
+	return last
+}
+
+// auditFile is the JSONL log of index mutations kept beside the index
+func auditFile(indexPath string) string {
+	return indexPath + ".audit.jsonl"
+}
+
+func appendAudit(indexPath string, entry AuditEntry) error {
+	f, err := os.OpenFile(auditFile(indexPath), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Encode writes the entry followed by a newline, i.e. one JSONL record
+	return json.NewEncoder(f).Encode(entry)
+}
+
+// recordAudit logs a mutation after a successful save. Auditing is best
+// effort: a failure warns but never undoes or fails the save itself
+func recordAudit(store Store, command string, added, updated, removed []int, lastNum int) {
+	if len(added) == 0 && len(updated) == 0 && len(removed) == 0 {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:    time.Now(),
+		Command: command,
+		Added:   added,
+		Updated: updated,
+		Removed: removed,
+		LastNum: lastNum,
+	}
+	if err := store.AppendAudit(entry); err != nil {
+		warnf("failed to write audit log: %v\n", err)
+	}
+}
+
+func loadAudit(indexPath string) ([]AuditEntry, error) {
+	f, err := os.Open(auditFile(indexPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var entry AuditEntry
+		if err := dec.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("corrupt audit log %s: %v", auditFile(indexPath), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func showAudit(w io.Writer, store Store) error {
+	entries, err := store.LoadAudit()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "Audit log is empty.")
+		return nil
+	}
+
+	totals := make(map[string]int)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s  %-8s", entry.Time.Format("2006-01-02 15:04:05"), entry.Command)
+		if len(entry.Added) > 0 {
+			fmt.Fprintf(w, "  +%d added (%s)", len(entry.Added), formatNums(entry.Added))
+		}
+		if len(entry.Updated) > 0 {
+			fmt.Fprintf(w, "  ~%d updated (%s)", len(entry.Updated), formatNums(entry.Updated))
+		}
+		if len(entry.Removed) > 0 {
+			fmt.Fprintf(w, "  -%d removed (%s)", len(entry.Removed), formatNums(entry.Removed))
+		}
+		fmt.Fprintf(w, "  lastNum=%d\n", entry.LastNum)
+
+		totals["added"] += len(entry.Added)
+		totals["updated"] += len(entry.Updated)
+		totals["removed"] += len(entry.Removed)
+	}
+
+	fmt.Fprintf(w, "\n%d entries: %d added, %d updated, %d removed\n",
+		len(entries), totals["added"], totals["updated"], totals["removed"])
+	return nil
+}
+
+// favorites and comicTags annotate comics shown by displayComic; main
+// loads them before running a command
+var (
+	favorites = map[int]bool{}
+	comicTags = map[int][]string{}
+)
+
+// loadUserData fills favorites and comicTags from the store. It is best
+// effort: the annotations are a nicety, so a broken file only warns.
+func loadUserData(store Store) {
+	nums, err := store.LoadFavorites()
+	if err != nil {
+		warnf("%v\n", err)
+	}
+	for _, num := range nums {
+		favorites[num] = true
+	}
+
+	if tags, err := store.LoadTags(); err != nil {
+		warnf("%v\n", err)
+	} else {
+		comicTags = tags
+	}
+}
+
+// manageFavorites runs "fav add <num>", "fav remove <num>" and "fav list"
+func manageFavorites(store Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: fav add <number> | fav remove <number> | fav list")
+	}
+	nums, err := store.LoadFavorites()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return listFavorites(os.Stdout, store, nums)
+
+	case "add", "remove":
+		if len(args) < 2 {
+			return fmt.Errorf("comic number is required")
+		}
+		num, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			return fmt.Errorf("invalid comic number: %s", args[1])
+		}
+
+		i := slices.Index(nums, num)
+		if args[0] == "add" {
+			if i >= 0 {
+				fmt.Printf("Comic #%d is already a favorite.\n", num)
+				return nil
+			}
+			if _, exists, err := store.Get(num); err != nil {
+				return err
+			} else if !exists {
+				return fmt.Errorf("comic #%d not found in index", num)
+			}
+			nums = append(nums, num)
+		} else {
+			if i < 0 {
+				return fmt.Errorf("comic #%d is not a favorite", num)
+			}
+			nums = slices.Delete(nums, i, i+1)
+		}
+
+		if err := store.SaveFavorites(nums); err != nil {
+			return err
+		}
+		if args[0] == "add" {
+			fmt.Printf("Added comic #%d to favorites.\n", num)
+		} else {
+			fmt.Printf("Removed comic #%d from favorites.\n", num)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown fav command %q (use add, remove or list)", args[0])
+}
+
+// listFavorites displays the favorite comics in the order they were added
+func listFavorites(w io.Writer, store Store, nums []int) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var comics []*Comic
+	var missing []int
+	for _, num := range nums {
+		if comic, exists := index.Comics[num]; exists {
+			comics = append(comics, comic)
+		} else {
+			missing = append(missing, num)
+		}
+	}
+
+	if *jsonFlag {
+		if err := printJSON(w, append([]*Comic{}, comics...)); err != nil {
+			return err
+		}
+	} else if len(nums) == 0 {
+		fmt.Fprintln(w, "No favorites yet. Add one with 'fav add <number>'.")
+	} else {
+		for i, comic := range comics {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			displayComic(w, comic, nil)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("favorites not found in index: %s", formatNums(missing))
+	}
+	return nil
+}
+
+// maxHistory is how many viewed comics the history keeps
+const maxHistory = 100
+
+// recordViews adds comics to the viewing history, dropping the oldest
+// entries beyond maxHistory. Like the audit log it is best effort: a
+// failure only warns.
+func recordViews(store Store, nums ...int) {
+	if len(nums) == 0 {
+		return
+	}
+	entries, err := store.LoadHistory()
+	if err != nil {
+		warnf("failed to update history: %v\n", err)
+		return
+	}
+
+	now := time.Now()
+	for _, num := range nums {
+		entries = append(entries, HistoryEntry{Num: num, Time: now})
+	}
+	if len(entries) > maxHistory {
+		entries = entries[len(entries)-maxHistory:]
+	}
+	if err := store.SaveHistory(entries); err != nil {
+		warnf("failed to update history: %v\n", err)
+	}
+}
+
+// manageHistory runs "history" and "history clear"
+func manageHistory(w io.Writer, store Store, args []string) error {
+	if len(args) > 0 {
+		if args[0] != "clear" {
+			return fmt.Errorf("unknown history command %q (use clear)", args[0])
+		}
+		if err := store.SaveHistory([]HistoryEntry{}); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "History cleared.")
+		return nil
+	}
+
+	entries, err := store.LoadHistory()
+	if err != nil {
+		return err
+	}
+	slices.Reverse(entries)
+
+	if *jsonFlag {
+		return printJSON(w, append([]HistoryEntry{}, entries...))
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No comics viewed yet.")
+		return nil
+	}
+
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		title := "(not in index)"
+		if comic, exists := index.Comics[entry.Num]; exists {
+			title = comic.Title
+		}
+		fmt.Fprintf(w, "%s  #%-5d %s\n", entry.Time.Local().Format("2006-01-02 15:04"), entry.Num, title)
+	}
+	return nil
+}
+
+// manageTags runs "tag add <num> <tag...>", "tag remove <num> <tag>",
+// "tag search <tag>" and "tag list"
+func manageTags(store Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tag add <number> <tag...> | tag remove <number> <tag> | tag search <tag> | tag list")
+	}
+	tags, err := store.LoadTags()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		counts := make(map[string]int)
+		for _, labels := range tags {
+			for _, tag := range labels {
+				counts[tag]++
+			}
+		}
+		if *jsonFlag {
+			return printJSON(os.Stdout, counts)
+		}
+		if len(counts) == 0 {
+			fmt.Println("No tags yet. Add one with 'tag add <number> <tag>'.")
+			return nil
+		}
+		names := slices.Sorted(maps.Keys(counts))
+		for _, name := range names {
+			fmt.Printf("%-20s %d\n", name, counts[name])
+		}
+		return nil
+
+	case "search":
+		if len(args) < 2 {
+			return fmt.Errorf("tag is required")
+		}
+		return searchTag(os.Stdout, store, tags, normalizeTag(args[1]))
+
+	case "add", "remove":
+		if len(args) < 3 {
+			return fmt.Errorf("comic number and tag are required")
+		}
+		num, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			return fmt.Errorf("invalid comic number: %s", args[1])
+		}
+
+		if args[0] == "add" {
+			if _, exists, err := store.Get(num); err != nil {
+				return err
+			} else if !exists {
+				return fmt.Errorf("comic #%d not found in index", num)
+			}
+			for _, tag := range args[2:] {
+				if tag = normalizeTag(tag); tag != "" && !slices.Contains(tags[num], tag) {
+					tags[num] = append(tags[num], tag)
+				}
+			}
+			slices.Sort(tags[num])
+		} else {
+			tag := normalizeTag(args[2])
+			i := slices.Index(tags[num], tag)
+			if i < 0 {
+				return fmt.Errorf("comic #%d is not tagged %q", num, tag)
+			}
+			tags[num] = slices.Delete(tags[num], i, i+1)
+			if len(tags[num]) == 0 {
+				delete(tags, num)
+			}
+		}
+
+		if err := store.SaveTags(tags); err != nil {
+			return err
+		}
+		fmt.Printf("Comic #%d tags: %s\n", num, valueOr(strings.Join(tags[num], ", "), "(none)"))
+		return nil
+	}
+	return fmt.Errorf("unknown tag command %q (use add, remove, search or list)", args[0])
+}
+
+// normalizeTag makes tags case-insensitive
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// searchTag lists the comics carrying tag, in number order
+func searchTag(w io.Writer, store Store, tags map[int][]string, tag string) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var comics []*Comic
+	for num, labels := range tags {
+		if comic, exists := index.Comics[num]; exists && slices.Contains(labels, tag) {
+			comics = append(comics, comic)
+		}
+	}
+	sort.Slice(comics, func(i, j int) bool {
+		return comics[i].Num < comics[j].Num
+	})
+
+	if *jsonFlag {
+		return printJSON(w, append([]*Comic{}, comics...))
+	}
+	if len(comics) == 0 {
+		fmt.Fprintf(w, "No comics tagged '%s'\n", tag)
+		return nil
+	}
+	for _, comic := range comics {
+		fmt.Fprintf(w, "#%-5d %s  %s\n", comic.Num, formatDate(comic), comic.Title)
+	}
+	fmt.Fprintf(w, "\n%d comics tagged '%s'\n", len(comics), tag)
+	return nil
+}
+
+// formatNums renders comic numbers compactly, collapsing runs into ranges:
+// [1 2 3 5 7 8] -> "#1-#3, #5, #7-#8"
+func formatNums(nums []int) string {
+	sorted := append([]int(nil), nums...)
+	sort.Ints(sorted)
+
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprintf("#%d", sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("#%d-#%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// searchOptions holds the flags of the search command that change
+// which comics match
+type searchOptions struct {
+	regex         bool		// Treat the query as one regular expression
+	wholeWord     bool		// Only match complete words, so "go" doesn't match "google"
+	dates         dateRange	// Only consider comics published in this range
+	stopwords     bool		// Keep common words like "the" in the query instead of dropping them
+	caseSensitive bool		// Match case exactly, so "IT" doesn't match "it"
+	minScore      int		// Drop results scoring below this
+}
+
+func search(store Store, query string, opts searchOptions) ([]*SearchResult, error) {
+	index, err := store.Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(index.Comics) == 0 {
+		return nil, fmt.Errorf("index is empty. Run 'update' first")
+	}
+
+	var re *regexp.Regexp
+	var expr *queryNode
+	var terms []searchTerm
+	if opts.regex {
+		if re, err = compileQueryRegex(query, opts); err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", query, err)
+		}
+	} else {
+		if expr, err = parseQuery(query); err != nil {
+			return nil, err
+		}
+		if !opts.caseSensitive {
+			expr.foldCase()
+		}
+		if !opts.stopwords {
+			// A query of nothing but stopwords is searched as written
+			if trimmed := expr.withoutStopwords(); trimmed != nil {
+				expr = trimmed
+			}
+		}
+		if opts.wholeWord {
+			expr.setWholeWord()
+		}
+		// Only terms the comic should contain contribute to its score
+		terms = expr.positiveTerms()
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("query %q only excludes terms; add a term to search for", query)
+		}
+	}
+
+	// With the word index, only the comics containing one of the terms are
+	// read. That includes every match, and every comic the term weights
+	// count.
+	var candidates map[int]bool
+	if expr != nil && expr.needsTerm() {
+		words := index.searchWords()
+		candidates = make(map[int]bool)
+		for _, term := range terms {
+			found, ok := words.lookup(term)
+			if !ok {
+				candidates = nil
+				break
+			}
+			for num := range found {
+				candidates[num] = true
+			}
+		}
+	}
+
+	// The comics that may match, each with its lowercased text. total
+	// counts every comic in the date range, for the term weights.
+	var comics []*Comic
+	total := 0
+	for num, comic := range index.Comics {
+		if !opts.dates.contains(comic) {
+			continue
+		}
+		total++
+		if candidates == nil || candidates[num] {
+			comics = append(comics, comic)
+		}
+	}
+	var texts []*comicText
+	if opts.caseSensitive {
+		texts = make([]*comicText, len(comics))
+		for i, comic := range comics {
+			texts[i] = &comicText{comic.Title, comic.SafeTitle, comic.Alt, comic.Transcript}
+		}
+	} else {
+		texts = index.searchTexts(comics)
+	}
+
+	var score func(text *comicText) int
+	if re != nil {
+		score = func(text *comicText) int {
+			return scoreFields(text, re.MatchString)
+		}
+	} else {
+		weights := termWeights(texts, terms, total)
+		score = func(text *comicText) int {
+			if !expr.matches(text) {
+				return 0
+			}
+			return weightedScore(text, terms, weights)
+		}
+	}
+
+	var results []*SearchResult		// Contains *Comic, score
+	var mu sync.Mutex
+
+	// Each shard collects its matches on its own and adds them at the end
+	inShards(len(comics), func(lo, hi int) {
+		var found []*SearchResult
+		for i := lo; i < hi; i++ {
+			if score := score(texts[i]); score > 0 && score >= opts.minScore {
+				found = append(found, &SearchResult{
+					Comic: comics[i],
+					Score: score,
+				})
+			}
+		}
+		mu.Lock()
+		results = append(results, found...)
+		mu.Unlock()
+	})
+
+	// Order by score; callers rely on the best match coming first
+	sortResults(results, "score")
+
+	return results, nil
+}
+
+// sortOrders are the values accepted by search -sort
+var sortOrders = []string{"score", "date", "num"}
+
+// sortResults orders results by score (best first), date (newest first)
+// or comic number (ascending). Equal scores put the newer comic first.
+func sortResults(results []*SearchResult, by string) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch by {
+		case "date":
+			return newer(a.Comic, b.Comic)
+		case "num":
+			return a.Comic.Num < b.Comic.Num
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return newer(a.Comic, b.Comic)
+	})
+}
+
+// newer reports whether a was published after b, falling back to the comic
+// number when the dates are equal. Comics without a valid date sort after
+// dated ones, which keeps the ordering consistent for sort.Slice so equal
+// scores always come out in the same order.
+func newer(a, b *Comic) bool {
+	dateA, errA := a.Date()
+	dateB, errB := b.Date()
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	if errA == nil && !dateA.Equal(dateB) {
+		return dateA.After(dateB)
+	}
+	return a.Num > b.Num
+}
+
+// compileQueryRegex compiles a -regex query. (?i) keeps regex searches
+// case-insensitive like keyword searches, unless -case-sensitive is given.
+func compileQueryRegex(query string, opts searchOptions) (*regexp.Regexp, error) {
+	if opts.wholeWord {
+		query = `\b(?:` + query + `)\b`
+	}
+	if !opts.caseSensitive {
+		query = "(?i)" + query
+	}
+	return regexp.Compile(query)
+}
+
+// queryOp is the kind of a node in a parsed search query
+type queryOp int
+
+const (
+	opTerm queryOp = iota
+	opAnd
+	opOr
+	opNot
+)
+
+// searchTerm is a word or phrase, optionally scoped to a single comic
+// field ("title", "alt" or "transcript"; "" searches them all). It is
+// lowercased by foldCase unless the search is case-sensitive.
+type searchTerm struct {
+	text      string
+	field     string
+	wholeWord bool		// Match only complete words, see containsWords
+	quoted    bool		// Written in quotes, so never dropped as a stopword
+}
+
+// match reports whether text contains the term. Both are already
+// lowercased, unless the search is case-sensitive.
+func (t searchTerm) match(text string) bool {
+	if t.wholeWord {
+		return containsWords(splitWords(text), splitWords(t.text))
+	}
+	return strings.Contains(text, t.text)
+}
+
+// words splits text into lowercased runs of letters and digits
+func words(text string) []string {
+	return splitWords(strings.ToLower(text))
+}
+
+// splitWords splits text into runs of letters and digits, keeping case
+func splitWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsWords reports whether needle occurs in haystack as a run of
+// consecutive words, which lets quoted phrases match whole words too
+func containsWords(haystack, needle []string) bool {
+	if len(needle) == 0 {
+		return false
+	}
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		matched := true
+		for j, word := range needle {
+			if haystack[i+j] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// searchFields are the prefixes accepted for field-scoped terms
+var searchFields = map[string]bool{
+	"title":      true,
+	"alt":        true,
+	"transcript": true,
+}
+
+// queryNode is a boolean search expression
+type queryNode struct {
+	op       queryOp
+	term     searchTerm
+	children []*queryNode
+}
+
+// foldCase lowercases every term of the query for a case-insensitive search
+func (n *queryNode) foldCase() {
+	if n.op == opTerm {
+		n.term.text = strings.ToLower(n.term.text)
+	}
+	for _, child := range n.children {
+		child.foldCase()
+	}
+}
+
+// setWholeWord switches every term of the query to whole-word matching
+func (n *queryNode) setWholeWord() {
+	if n.op == opTerm {
+		n.term.wholeWord = true
+	}
+	for _, child := range n.children {
+		child.setWholeWord()
+	}
+}
+
+// matches reports whether the comic satisfies the expression; a term
+// matches when it occurs in any text field
+func (n *queryNode) matches(text *comicText) bool {
+	switch n.op {
+	case opTerm:
+		return calculateScore(text, []searchTerm{n.term}) > 0
+	case opAnd:
+		for _, child := range n.children {
+			if !child.matches(text) {
+				return false
+			}
+		}
+		return true
+	case opOr:
+		for _, child := range n.children {
+			if child.matches(text) {
+				return true
+			}
+		}
+		return false
+	case opNot:
+		return !n.children[0].matches(text)
+	}
+	return false
+}
+
+// withoutStopwords drops the stopword terms the query asks for, so
+// "the" or "of" don't rank comics that merely contain them. Quoted and
+// excluded terms stay. It returns nil when nothing but stopwords is left.
+func (n *queryNode) withoutStopwords() *queryNode {
+	switch n.op {
+	case opTerm:
+		if !n.term.quoted && stopwords[n.term.text] {
+			return nil
+		}
+		return n
+	case opNot:
+		return n
+	}
+
+	var children []*queryNode
+	for _, child := range n.children {
+		if kept := child.withoutStopwords(); kept != nil {
+			children = append(children, kept)
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	// NOT alone would turn "the -cat" into a query that only excludes
+	if n.op == opAnd && !slices.ContainsFunc(children, func(c *queryNode) bool { return c.op != opNot }) {
+		return nil
+	}
+	return combine(n.op, children)
+}
+
+// needsTerm reports whether every comic matching the expression contains
+// at least one of its positive terms. "a -b" does, but "NOT a OR b" also
+// matches comics with neither.
+func (n *queryNode) needsTerm() bool {
+	switch n.op {
+	case opTerm:
+		return true
+	case opOr:
+		for _, child := range n.children {
+			if !child.needsTerm() {
+				return false
+			}
+		}
+		return true
+	case opAnd:
+		return slices.ContainsFunc(n.children, (*queryNode).needsTerm)
+	}
+	return false
+}
+
+// positiveTerms lists the terms that are not negated, i.e. the ones whose
+// presence should raise a comic's score
+func (n *queryNode) positiveTerms() []searchTerm {
+	switch n.op {
+	case opTerm:
+		return []searchTerm{n.term}
+	case opNot:
+		return nil
+	}
+	var terms []searchTerm
+	for _, child := range n.children {
+		terms = append(terms, child.positiveTerms()...)
+	}
+	return terms
+}
+
+// queryParser is a recursive-descent parser for the search syntax, from
+// loosest to tightest binding:
+//
+//	query := or+        adjacent expressions: positives OR'd, exclusions AND'd
+//	or    := and ("OR" and)*
+//	and   := unary ("AND" unary)*
+//	unary := "NOT" unary | "-"term | term
+//	term  := [field:] (word | "quoted phrase")
+//
+// A query with no operators is therefore a plain OR of its terms.
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// queryToken is a word or quoted phrase of the query. Quoted and negated
+// tokens are always terms, so "AND" in quotes searches for the word.
+type queryToken struct {
+	text    string
+	field   string	// Field prefix such as title: ("" for none)
+	quoted  bool
+	negated bool	// Written with a leading "-"
+}
+
+// isOperator reports whether the token is the bare keyword op
+func (t queryToken) isOperator(op string) bool {
+	return !t.quoted && !t.negated && t.field == "" && t.text == op
+}
+
+func parseQuery(query string) (*queryNode, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("search query is empty")
+	}
+
+	p := &queryParser{tokens: tokens}
+	return p.parseSequence()
+}
+
+// tokenizeQuery splits a query on whitespace, keeping double-quoted
+// phrases together: git "merge conflict" -> [git] [merge conflict]
+func tokenizeQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var tok queryToken
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			tok.negated = true
+			i++
+		}
+
+		var text strings.Builder
+		inQuote := false
+		for ; i < len(runes) && (inQuote || !unicode.IsSpace(runes[i])); i++ {
+			if runes[i] == '"' {
+				inQuote = !inQuote
+				tok.quoted = true
+				continue
+			}
+			// A known field name before the first colon scopes the term
+			if runes[i] == ':' && !tok.quoted && tok.field == "" && searchFields[strings.ToLower(text.String())] {
+				tok.field = strings.ToLower(text.String())
+				text.Reset()
+				continue
+			}
+			text.WriteRune(runes[i])
+		}
+		if inQuote {
+			return nil, fmt.Errorf("unterminated quote in query %q", query)
+		}
+
+		// Normalize inner whitespace so a phrase matches single-spaced text
+		tok.text = strings.Join(strings.Fields(text.String()), " ")
+		if tok.text == "" && tok.field != "" {
+			return nil, fmt.Errorf("missing search term after %s:", tok.field)
+		}
+		if tok.text != "" {
+			tokens = append(tokens, tok)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return queryToken{}
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *queryParser) parseSequence() (*queryNode, error) {
+	var include, exclude []*queryNode
+	for p.pos < len(p.tokens) {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if node.op == opNot {
+			exclude = append(exclude, node)
+		} else {
+			include = append(include, node)
+		}
+	}
+
+	// e.g. "cat dog -sudo" -> (cat OR dog) AND NOT sudo
+	all := exclude
+	if len(include) > 0 {
+		all = append([]*queryNode{combine(opOr, include)}, exclude...)
+	}
+	return combine(opAnd, all), nil
+}
+
+func (p *queryParser) parseOr() (*queryNode, error) {
+	return p.parseBinary("OR", opOr, p.parseAnd)
+}
+
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	return p.parseBinary("AND", opAnd, p.parseUnary)
+}
+
+// parseBinary parses operands separated by the given operator keyword
+func (p *queryParser) parseBinary(keyword string, op queryOp, operand func() (*queryNode, error)) (*queryNode, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []*queryNode{first}
+	for p.peek().isOperator(keyword) {
+		p.next()
+		node, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return combine(op, nodes), nil
+}
+
+func (p *queryParser) parseUnary() (*queryNode, error) {
+	tok := p.next()
+	switch {
+	case tok.text == "":
+		return nil, fmt.Errorf("query ends where a term was expected")
+	case tok.isOperator("AND") || tok.isOperator("OR"):
+		return nil, fmt.Errorf("%s must be placed between two terms", tok.text)
+	case tok.isOperator("NOT"):
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNode{op: opNot, children: []*queryNode{child}}, nil
+	}
+
+	term := &queryNode{op: opTerm, term: searchTerm{
+		text:   tok.text,
+		field:  tok.field,
+		quoted: tok.quoted,
+	}}
+	if tok.negated {
+		return &queryNode{op: opNot, children: []*queryNode{term}}, nil
+	}
+	return term, nil
+}
+
+// combine joins nodes under op, skipping the wrapper for a single node
+func combine(op queryOp, nodes []*queryNode) *queryNode {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return &queryNode{op: op, children: nodes}
+}
+
+// inShards splits the indexes 0 to n-1 into one contiguous range per CPU
+// and calls fn for each range in its own goroutine, returning once all of
+// them are done. Searching a large index this way uses every core.
+func inShards(n int, fn func(lo, hi int)) {
+	shards := min(runtime.GOMAXPROCS(0), n)
+	var wg sync.WaitGroup
+	for s := 0; s < shards; s++ {
+		lo, hi := n*s/shards, n*(s+1)/shards
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(lo, hi)
+		}()
+	}
+	wg.Wait()
+}
+
+// comicText holds the searchable fields of a comic lowercased, so that
+// matching several terms against a comic lowercases each field only once.
+// A case-sensitive search fills it with the fields as they are.
+type comicText struct {
+	title, safeTitle, alt, transcript string
+}
+
+// wordIndex maps every word of the comics' text to the comics containing
+// it, so that a search only looks at comics that can match
+type wordIndex struct {
+	postings map[string][]int	// Word -> numbers of the comics containing it
+	grams    map[string][]string	// Trigram -> words containing it, for terms inside words
+	vocab    []string			// Every word, scanned for terms too short for a trigram
+	comics   int				// Number of comics indexed, to notice comics added since
+}
+
+// wordsMu guards the word index of an index searched concurrently by serve
+var wordsMu sync.Mutex
+
+// searchWords returns the word index of index, building it on first use.
+// Building reads every comic, so for an index loaded from a file it is
+// cached in a side file, tied to the index by the checksum saveIndex
+// records: the first search after the index changes rebuilds it.
+func (index *Index) searchWords() *wordIndex {
+	wordsMu.Lock()
+	defer wordsMu.Unlock()
+
+	if index.words != nil && index.words.comics == len(index.Comics) {
+		return index.words
+	}
+	sum, _ := readChecksum(index.path)
+	if index.path == "" || sum == "" {
+		index.indexWords()
+		return index.words
+	}
+
+	var cache wordCache
+	if err := loadWordCache(wordsFile(index.path), &cache); err == nil && cache.Checksum == sum {
+		index.words = newWordIndex(cache.Postings, len(index.Comics))
+		return index.words
+	}
+	index.indexWords()
+	cache = wordCache{Checksum: sum, Postings: index.words.postings}
+	if err := saveWordCache(wordsFile(index.path), &cache); err != nil {
+		debugf("Could not cache the word index: %v\n", err)
+	}
+	return index.words
+}
+
+// wordsFile caches the word index of the index at indexPath
+func wordsFile(indexPath string) string {
+	return indexPath + ".words.gob"
+}
+
+// wordCache is the word index as saved in wordsFile. Only the postings are
+// kept: the rest is quick to derive from them.
+type wordCache struct {
+	Checksum string				// Checksum of the index the postings were built from
+	Postings map[string][]int
+}
+
+// The postings run into millions of numbers for a large index, which gob
+// decodes several times faster than JSON
+func loadWordCache(path string, cache *wordCache) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(bufio.NewReader(f)).Decode(cache)
+}
+
+func saveWordCache(path string, cache *wordCache) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cache); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// indexWords builds the word index from the comics' text
+func (index *Index) indexWords() {
+	postings := make(map[string][]int)
+	for num, comic := range index.Comics {
+		if comic == nil {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, field := range []string{comic.Title, comic.SafeTitle, comic.Alt, comic.Transcript} {
+			for _, word := range words(field) {
+				if !seen[word] {
+					seen[word] = true
+					postings[word] = append(postings[word], num)
+				}
+			}
+		}
+	}
+	index.words = newWordIndex(postings, len(index.Comics))
+}
+
+// newWordIndex completes a word index from its postings
+func newWordIndex(postings map[string][]int, comics int) *wordIndex {
+	w := &wordIndex{
+		postings: postings,
+		grams:    make(map[string][]string),
+		vocab:    slices.Sorted(maps.Keys(postings)),
+		comics:   comics,
+	}
+	for _, word := range w.vocab {
+		for _, gram := range trigrams(word) {
+			w.grams[gram] = append(w.grams[gram], word)
+		}
+	}
+	return w
+}
+
+// trigrams returns the distinct runs of three letters in word
+func trigrams(word string) []string {
+	runes := []rune(word)
+	var grams []string
+	for i := 0; i+3 <= len(runes); i++ {
+		if gram := string(runes[i : i+3]); !slices.Contains(grams, gram) {
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// containing returns the indexed words that contain word. A word of three
+// letters or more is looked up by its rarest trigram, since every word
+// containing it contains each of its trigrams; only shorter words need a
+// scan of the whole vocabulary.
+func (w *wordIndex) containing(word string) []string {
+	candidates := w.vocab
+	for i, gram := range trigrams(word) {
+		if i == 0 || len(w.grams[gram]) < len(candidates) {
+			candidates = w.grams[gram]
+		}
+	}
+
+	var found []string
+	for _, v := range candidates {
+		if strings.Contains(v, word) {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+// lookup returns the comics that may contain term: those containing each
+// of its words, either exactly (whole-word terms) or inside a longer word,
+// as "go" occurs in "google". Since a term's words occur in the text
+// wherever the term does, this never misses a match; the caller still
+// checks the text. ok is false for a term without any words to look up.
+func (w *wordIndex) lookup(term searchTerm) (comics map[int]bool, ok bool) {
+	termWords := words(term.text)
+	if len(termWords) == 0 {
+		return nil, false
+	}
+
+	for i, word := range termWords {
+		found := make(map[int]bool)
+		add := func(word string) {
+			for _, num := range w.postings[word] {
+				found[num] = true
+			}
+		}
+		if term.wholeWord {
+			add(word)
+		} else {
+			for _, v := range w.containing(word) {
+				add(v)
+			}
+		}
+
+		if i == 0 {
+			comics = found
+		} else {
+			comics = intersect(comics, found)
+		}
+	}
+	return comics, true
+}
+
+// intersect returns the comic numbers in both a and b
+func intersect(a, b map[int]bool) map[int]bool {
+	both := make(map[int]bool)
+	for num := range a {
+		if b[num] {
+			both[num] = true
+		}
+	}
+	return both
+}
+
+// corpusMu guards Index.corpus, since the API server searches one index
+// from several requests at once
+var corpusMu sync.Mutex
+
+// searchTexts returns the lowercased text of each comic. The texts are
+// kept with the index, so searching the same index again (in tui or
+// serve) skips straight to matching. They're keyed by comic pointer: a
+// comic replaced by an update gets its text rebuilt.
+func (index *Index) searchTexts(comics []*Comic) []*comicText {
+	corpusMu.Lock()
+	defer corpusMu.Unlock()
+
+	// Drop the texts of removed or replaced comics once they pile up
+	if index.corpus == nil || len(index.corpus) > len(index.Comics) {
+		index.corpus = make(map[*Comic]*comicText, len(index.Comics))
+	}
+
+	texts := make([]*comicText, len(comics))
+	var missing []int
+	for i, comic := range comics {
+		if text, ok := index.corpus[comic]; ok {
+			texts[i] = text
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	inShards(len(missing), func(lo, hi int) {
+		for _, i := range missing[lo:hi] {
+			texts[i] = newComicText(comics[i])
+		}
+	})
+	for _, i := range missing {
+		index.corpus[comics[i]] = texts[i]
+	}
+	return texts
+}
+
+func newComicText(comic *Comic) *comicText {
+	return &comicText{
+		title:      strings.ToLower(comic.Title),
+		safeTitle:  strings.ToLower(comic.SafeTitle),
+		alt:        strings.ToLower(comic.Alt),
+		transcript: strings.ToLower(comic.Transcript),
+	}
+}
+
+// Score weights per field: title matches count most, transcript least
+const (
+	titleWeight      = 10
+	safeTitleWeight  = 8
+	altWeight        = 5
+	transcriptWeight = 3
+)
+
+func calculateScore(text *comicText, terms []searchTerm) int {
+	score := 0
+	for _, term := range terms {
+		match := term.match
+
+		// A scoped term only consults its own field
+		switch term.field {
+		case "title":
+			if match(text.title) {
+				score += titleWeight
+			}
+		case "alt":
+			if match(text.alt) {
+				score += altWeight
+			}
+		case "transcript":
+			if match(text.transcript) {
+				score += transcriptWeight
+			}
+		default:
+			score += scoreFields(text, match)
+		}
+	}
+	return score
+}
+
+// termWeights scales each term by how rare it is among the total comics
+// searched (inverse document frequency), so in "the hammer" a match on
+// hammer counts for more than a match on the. The rarest term weighs 1,
+// which leaves single-term scores unchanged. Comics left out of texts
+// are taken to match none of the terms.
+func termWeights(texts []*comicText, terms []searchTerm, total int) []float64 {
+	freq := make([]int, len(terms))
+	var mu sync.Mutex
+	inShards(len(texts), func(lo, hi int) {
+		counts := make([]int, len(terms))
+		for _, text := range texts[lo:hi] {
+			for i, term := range terms {
+				if calculateScore(text, []searchTerm{term}) > 0 {
+					counts[i]++
+				}
+			}
+		}
+		mu.Lock()
+		for i, count := range counts {
+			freq[i] += count
+		}
+		mu.Unlock()
+	})
+
+	weights := make([]float64, len(terms))
+	top := 0.0
+	for i := range terms {
+		weights[i] = 1 + math.Log(float64(total+1)/float64(freq[i]+1))
+		top = max(top, weights[i])
+	}
+	for i := range weights {
+		weights[i] /= top
+	}
+	return weights
+}
+
+// weightedScore is calculateScore with each term's points scaled by its
+// weight. A comic that matches scores at least 1.
+func weightedScore(text *comicText, terms []searchTerm, weights []float64) int {
+	score := 0.0
+	for i, term := range terms {
+		score += float64(calculateScore(text, []searchTerm{term})) * weights[i]
+	}
+	return max(1, int(math.Round(score)))
+}
+
+// scoreFields weighs where match succeeds in a comic's text fields. Each
+// field is matched on its own, so a term never matches across the
+// boundary between two fields.
+func scoreFields(text *comicText, match func(text string) bool) int {
+	score := 0
+
+	// Title matches receive higher scores
+	// if title contains the words in terms (searching keywords)
+	if match(text.title) {
+		score += titleWeight
+	}
+	if match(text.safeTitle) {
+		score += safeTitleWeight
+	}
+	// Alt match
+	if match(text.alt) {
+		score += altWeight
+	}
+	// Transcript match
+	if match(text.transcript) {
+		score += transcriptWeight
+	}
+	return score
+}
+
+// similarTitleThreshold is the word overlap above which two titles are
+// considered variations of the same comic (e.g. a numbered series)
+const similarTitleThreshold = 0.6
+
+// titleWords returns the set of alphabetic words in a title, ignoring
+// numbers and punctuation so "Barrel - Part 1" and "Barrel - Part 2" agree
+func titleWords(title string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		words[word] = true
+	}
+	return words
+}
+
+// titleSimilarity is the Jaccard index of the two titles' word sets
+func titleSimilarity(a, b string) float64 {
+	wordsA, wordsB := titleWords(a), titleWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(wordsA)+len(wordsB)-shared)
+}
+
+// groupSimilar collapses ranked results whose titles are near-duplicates,
+// keeping the best-scoring result of each group and attaching the rest
+// to it as Similar. Ranking order is preserved.
+func groupSimilar(results []*SearchResult) []*SearchResult {
+	var groups []*SearchResult
+	for _, result := range results {
+		grouped := false
+		for _, group := range groups {
+			if titleSimilarity(group.Comic.Title, result.Comic.Title) >= similarTitleThreshold {
+				group.Similar = append(group.Similar, result)
+				grouped = true
+				break
+			}
+		}
+		if !grouped {
+			groups = append(groups, result)
+		}
+	}
+	return groups
+}
+
+// printSearchResult writes one ranked search result, followed by a blank
+// line. expand also lists the near-duplicates folded into it.
+func printSearchResult(w io.Writer, rank int, result *SearchResult, scoreText string, hl *highlighter, expand bool) {
+	fmt.Fprintf(w, "%d. %s: %s %s\n", rank,
+		colorize(fmt.Sprintf("#%d", result.Comic.Num), ansiCyan),
+		colorize(hl.apply(result.Comic.Title), ansiBold),
+		colorize("("+scoreText+")", ansiDim))
+	fmt.Fprintf(w, "   URL: %s\n", comicURL(result.Comic.Num))
+	fmt.Fprintf(w, "   %s\n", hl.apply(result.Comic.Alt))
+	if result.Snippet != "" {
+		fmt.Fprintf(w, "   %s %s\n", colorize("Transcript:", ansiDim), hl.apply(result.Snippet))
+	}
+	if len(result.Similar) > 0 {
+		fmt.Fprintf(w, "   (+%d similar)\n", len(result.Similar))
+		if expand {
+			for _, similar := range result.Similar {
+				fmt.Fprintf(w, "     - #%d: %s (score: %d)\n",
+					similar.Comic.Num, similar.Comic.Title, similar.Score)
+			}
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// normalizeScore scales a raw score to 0-100 relative to the best score
+// of the same query
+func normalizeScore(score, topScore int) int {
+	if topScore <= 0 {
+		return 0
+	}
+	return score * 100 / topScore
+}
+
+// displayComic prints a comic in a box, marking matches of hl (may be nil)
+func displayComic(w io.Writer, comic *Comic, hl *highlighter) {
+	if plainOutput() {
+		displayPlain(w, comic, hl)
+		return
+	}
+	b := box{width: displayWidth()}
+
+	heading := fmt.Sprintf("XKCD #%d", comic.Num)
+	if favorites[comic.Num] {
+		heading += " ★"
+	}
+	fmt.Fprintln(w, b.top(heading))
+
+	// Highlight after wrapping, so escape codes neither count toward the
+	// width nor get split across lines
+	field := func(label, value string, hl *highlighter) {
+		indent := strings.Repeat(" ", utf8.RuneCountInString(label))
+		for i, line := range wrapText(value, b.width-len(indent)) {
+			if i > 0 {
+				label = indent
+			}
+			fmt.Fprintln(w, b.line(label + hl.apply(line)))
+		}
+	}
+	field("Title: ", comic.Title, hl)
+	for _, detail := range comicDetails(comic) {
+		field(detail.label, detail.value, nil)
+	}
+
+	fmt.Fprintln(w, b.divider("Alt Text"))
+	for _, line := range wrapText(comic.Alt, b.width) {
+		fmt.Fprintln(w, b.line(hl.apply(line)))
+	}
+	if comic.Transcript != "" {
+		fmt.Fprintln(w, b.divider("Transcript"))
+		for _, line := range wrapText(comic.Transcript, b.width) {
+			fmt.Fprintln(w, b.line(hl.apply(line)))
+		}
+	}
+	fmt.Fprintln(w, b.bottom())
+}
+
+// comicDetail is one labeled line of comic metadata
+type comicDetail struct {
+	label, value string
+}
+
+// comicDetails lists the metadata displayComic shows below the title,
+// skipping what a comic doesn't have. Labels are padded to one width.
+func comicDetails(comic *Comic) []comicDetail {
+	details := []comicDetail{
+		{"Date:  ", formatDate(comic)},
+		{"URL:   ", comicURL(comic.Num)},
+		{"Image: ", comic.Img},
+	}
+	if local := cachedImage(comic); local != "" {
+		details = append(details, comicDetail{"Local: ", local})
+	}
+	if comic.Link != "" {
+		details = append(details, comicDetail{"Link:  ", comic.Link})
+	}
+	if comic.isInteractive() {
+		details = append(details, comicDetail{"Note:  ", "interactive comic, view it online"})
+	}
+	if tags := comicTags[comic.Num]; len(tags) > 0 {
+		details = append(details, comicDetail{"Tags:  ", strings.Join(tags, ", ")})
+	}
+	return details
+}
+
+// displayPlain shows the same information as displayComic as plain
+// "label: value" lines, without box-drawing characters or wrapping
+func displayPlain(w io.Writer, comic *Comic, hl *highlighter) {
+	heading := fmt.Sprintf("XKCD #%d", comic.Num)
+	if favorites[comic.Num] {
+		heading += " (favorite)"
+	}
+	fmt.Fprintln(w, heading)
+	fmt.Fprintf(w, "Title: %s\n", hl.apply(comic.Title))
+	for _, detail := range comicDetails(comic) {
+		fmt.Fprintf(w, "%s%s\n", detail.label, detail.value)
+	}
+	fmt.Fprintf(w, "Alt:   %s\n", hl.apply(comic.Alt))
+	if comic.Transcript != "" {
+		fmt.Fprintln(w, "Transcript:")
+		fmt.Fprintln(w, hl.apply(comic.Transcript))
+	}
+}
+
+// plainSet records whether -plain was given explicitly, set in main
+var plainSet bool
+
+// plainOutput decides whether displayComic drops the box: -plain (or
+// -plain=false) decides if given, otherwise any output that doesn't end
+// up on a terminal is plain
+func plainOutput() bool {
+	if plainSet {
+		return *plainFlag
+	}
+	return outputFile || (!pagerActive && !isTerminal(os.Stdout))
+}
+
+// Text widths inside the displayComic box: the fallback when the terminal
+// width is unknown, and the narrowest allowed
+const (
+	defaultDisplayWidth = 60
+	minDisplayWidth     = 20
+)
+
+// displayWidth is the text width inside the displayComic box: -width if
+// given, else the terminal width minus the borders
+func displayWidth() int {
+	if *widthFlag > 0 {
+		return max(*widthFlag, minDisplayWidth)
+	}
+	if !isTerminal(os.Stdout) && !pagerActive {
+		return defaultDisplayWidth
+	}
+	if _, cols := terminalSize(); cols > 0 {
+		return max(cols-4, minDisplayWidth)
+	}
+	return defaultDisplayWidth
+}
+
+// box draws a frame around lines of text, width columns wide inside; the
+// borders and padding add four more
+type box struct {
+	width int
+}
+
+func (b box) top(title string) string {
+	return b.rule("┌─ "+title+" ", "┐")
+}
+
+func (b box) divider(title string) string {
+	return b.rule("├─ "+title+" ", "┤")
+}
+
+func (b box) bottom() string {
+	return b.rule("└", "┘")
+}
+
+// rule fills the space between start and end with horizontal lines
+func (b box) rule(start, end string) string {
+	fill := b.width + 3 - visibleWidth(start)
+	return start + strings.Repeat("─", max(fill, 1)) + end
+}
+
+// line frames one line of text, padding it to the box width. text may
+// carry ANSI codes, which take up no columns.
+func (b box) line(text string) string {
+	pad := max(b.width-visibleWidth(text), 0)
+	return "│ " + text + strings.Repeat(" ", pad) + " │"
+}
+
+// ansiSequence matches the SGR escape codes added by colorize and highlighter
+var ansiSequence = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// visibleWidth is the number of columns text takes on screen
+func visibleWidth(text string) int {
+	return utf8.RuneCountInString(ansiSequence.ReplaceAllString(text, ""))
+}
+
+// highlighter marks matches of a search in displayed text. A nil
+// highlighter leaves text unchanged.
+type highlighter struct {
+	re *regexp.Regexp
+}
+
+// snippet returns about snippetWidth characters of text centered on the
+// first match of the highlighter, with "…" where it was cut, or "" if
+// nothing matches. Line breaks are joined into spaces.
+func (h *highlighter) snippet(text string) string {
+	if h == nil {
+		return ""
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	loc := h.re.FindStringIndex(text)
+	if loc == nil {
+		return ""
+	}
+
+	// Work in runes so the cut never splits a character
+	runes := []rune(text)
+	start := utf8.RuneCountInString(text[:loc[0]])
+	length := utf8.RuneCountInString(text[loc[0]:loc[1]])
+	from := max(0, start-(snippetWidth-length)/2)
+	to := min(len(runes), from+snippetWidth)
+	from = max(0, to-snippetWidth)
+
+	snippet := string(runes[from:to])
+	if from > 0 {
+		snippet = "…" + snippet
+	}
+	if to < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// newHighlighter builds a highlighter for the query as search interprets
+// it: the regex itself, or the terms a matching comic must contain
+func newHighlighter(query string, opts searchOptions) *highlighter {
+	if opts.regex {
+		re, err := compileQueryRegex(query, opts)
+		if err != nil {
+			return nil
+		}
+		return &highlighter{re: re}
+	}
+
+	expr, err := parseQuery(query)
+	if err != nil {
+		return nil
+	}
+	if !opts.caseSensitive {
+		expr.foldCase()
+	}
+	if trimmed := expr.withoutStopwords(); trimmed != nil && !opts.stopwords {
+		expr = trimmed
+	}
+	var patterns []string
+	for _, term := range expr.positiveTerms() {
+		patterns = append(patterns, regexp.QuoteMeta(term.text))
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	pattern := strings.Join(patterns, "|")
+	if opts.wholeWord {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if !opts.caseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	return &highlighter{re: regexp.MustCompile(pattern)}
+}
+
+func (h *highlighter) apply(text string) string {
+	if h == nil || !shouldColor() {
+		return text
+	}
+	return h.re.ReplaceAllStringFunc(text, func(match string) string {
+		return ansiHighlight + match + ansiHighlightEnd
+	})
+}
+
+// shouldColor decides whether output may carry ANSI colors. Precedence:
+// CLICOLOR_FORCE / -color > -no-color > NO_COLOR / CLICOLOR=0 > stdout is a TTY
+func shouldColor() bool {
+	if force := os.Getenv("CLICOLOR_FORCE"); force != "" && force != "0" {
+		return true
+	}
+	if *colorFlag {
+		return true
+	}
+	if *noColorFlag {
+		return false
+	}
+	// https://no-color.org: any non-empty value disables color
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("CLICOLOR") == "0" {
+		return false
+	}
+	return !outputFile && (pagerActive || isTerminal(os.Stdout))
+}
+
+// searchResultLines is roughly how many lines one search result takes
+const searchResultLines = 5
+
+// snippetWidth is how many characters of transcript a snippet shows
+const snippetWidth = 80
+
+// terminalRows is the terminal height, or the classic 24 rows when it
+// can't be determined
+func terminalRows() int {
+	if rows, _ := terminalSize(); rows > 0 {
+		return rows
+	}
+	return 24
+}
+
+// morePrompt asks whether to print the next page of results and reports
+// the answer: anything but q (or end of input) continues
+func morePrompt(in *bufio.Reader, remaining int) bool {
+	fmt.Print(colorize(fmt.Sprintf("-- %d more: Enter for the next page, q to quit -- ", remaining), ansiDim))
+	line, err := in.ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+	return strings.TrimSpace(line) != "q"
+}
+
+// pagerActive is set while os.Stdout is piped into a pager, which shows
+// the output on the terminal (less is run with -R to keep the colors)
+var pagerActive bool
+
+// startPager pipes os.Stdout through $PAGER, falling back to less and then
+// more, when writing to a terminal. It returns a function that closes the
+// pipe and waits for the user to quit the pager.
+func startPager() (stop func()) {
+	stop = func() {}
+	if *noPagerFlag || !isTerminal(os.Stdout) {
+		return stop
+	}
+	cmd := pagerCommand()
+	if cmd == nil {
+		return stop
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return stop
+	}
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return stop
+	}
+	r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	pagerActive = true
+	stopPager = func() {
+		if !pagerActive {
+			return
+		}
+		w.Close()
+		cmd.Wait()
+		os.Stdout = stdout
+		pagerActive = false
+	}
+	return stopPager
+}
+
+// stopPager closes the pager started by startPager, if any, and waits for
+// the user to quit it
+var stopPager = func() {}
+
+// fatalf is log.Fatalf for commands whose output may be paged. os.Exit
+// skips deferred calls, so it stops the pager first: otherwise the pager
+// would be left running behind the shell prompt, and the error would be
+// lost in its screen.
+func fatalf(format string, args ...any) {
+	stopPager()
+	log.Fatalf(format, args...)
+}
+
+// pagerCommand builds the pager to run, or nil if none is available. Like
+// git, it has less quit by itself when the output fits on one screen,
+// unless -pager is given.
+func pagerCommand() *exec.Cmd {
+	lessFlags := "-FRX"
+	if *pagerFlag {
+		lessFlags = "-RX"
+	}
+
+	if pager := strings.Fields(os.Getenv("PAGER")); len(pager) > 0 {
+		cmd := exec.Command(pager[0], pager[1:]...)
+		if os.Getenv("LESS") == "" {
+			cmd.Env = append(os.Environ(), "LESS="+lessFlags)
+		}
+		return cmd
+	}
+	if less, err := exec.LookPath("less"); err == nil {
+		return exec.Command(less, lessFlags)
+	}
+	if more, err := exec.LookPath("more"); err == nil {
+		return exec.Command(more)
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize wraps text in the given ANSI code when color is enabled
+func colorize(text, code string) string {
+	if !shouldColor() {
+		return text
+	}
+	return code + text + ansiReset
+}
+
+func wrapText(text string, width int) []string {
+	// Line breaks are kept, as transcripts put each speaker on a line
+	if strings.Contains(text, "\n") {
+		var lines []string
+		for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+			lines = append(lines, wrapText(line, width)...)
+		}
+		return lines
+	}
+
+	// Widths are measured in runes, not bytes, so accented letters, dashes
+	// and emoji count as one column each
+	if utf8.RuneCountInString(text) <= width {
+		return []string{text}
+	}
+
+	var lines []string
+	words := strings.Fields(text)
+	currentLine := ""
+
+	for _, word := range words {
+		// A token wider than the box (e.g. a long URL) is hard-wrapped
+		// at width boundaries so it can't overflow the border
+		if utf8.RuneCountInString(word) > width {
+			if currentLine != "" {
+				lines = append(lines, currentLine)
+			}
+			chunks := breakWord(word, width)
+			lines = append(lines, chunks[:len(chunks)-1]...)
+			currentLine = chunks[len(chunks)-1]
+			continue
+		}
+
+		if utf8.RuneCountInString(currentLine)+utf8.RuneCountInString(word)+1 <= width {
+			if currentLine == "" {
+				currentLine = word
+			} else {
+				currentLine += " " + word
+			}
+		} else {
+			if currentLine != "" {
+				lines = append(lines, currentLine)
+			}
+			currentLine = word
+		}
+	}
+
+	if currentLine != "" || len(lines) == 0 {
+		lines = append(lines, currentLine)
+	}
+
+	return lines
+}
+
+// breakWord splits a word into rune-aware pieces of at most width runes,
+// marking every piece but the last with wrapContinuation. A width below
+// one still makes progress, one rune per piece.
+func breakWord(word string, width int) []string {
+	width = max(width, 1)
+	step := width - utf8.RuneCountInString(wrapContinuation)
+	if step < 1 {
+		step = 1
+	}
+
+	var chunks []string
+	runes := []rune(word)
+	for len(runes) > width {
+		chunks = append(chunks, string(runes[:step])+wrapContinuation)
+		runes = runes[step:]
+	}
+	return append(chunks, string(runes))
+}
+
+// statsBreakdowns are the values accepted by stats -by
+var statsBreakdowns = []string{"year", "terms", "words"}
+
+// topTermsCount is how many words stats -by terms and -by words report
+const topTermsCount = 10
+
+// statsOptions holds the flags of the stats command
+type statsOptions struct {
+	by    string		// Breakdown: "", or one of statsBreakdowns
+	n     int			// Number of words listed by terms and words
+	dates dateRange		// Only count the words of comics in this range
+	csv   bool			// Print the word counts as CSV
+}
+
+// showStats prints totals and sample comics, or with opts.by set to
+// "year", "terms" or "words" a breakdown of comics per year or of the
+// commonest title or transcript words
+func showStats(w io.Writer, store Store, opts statsOptions) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var counts []TermCount
+	switch opts.by {
+	case "terms":
+		counts = topTerms(index, opts.n, opts.dates, titleTerms)
+	case "words":
+		counts = topTerms(index, opts.n, opts.dates, transcriptWords)
+	}
+
+	if *jsonFlag {
+		stats := IndexStats{
+			Total:   len(index.Comics),
+			LastNum: index.LastNum,
+			Updated: index.Updated,
+		}
+		switch opts.by {
+		case "year":
+			stats.ByYear = comicsByYear(index)
+		case "terms":
+			stats.TopTerms = counts
+		case "words":
+			stats.TopWords = counts
+		}
+		return printJSON(w, stats)
+	}
+
+	if opts.csv && counts != nil {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"word", "count"})
+		for _, tc := range counts {
+			cw.Write([]string{tc.Term, strconv.Itoa(tc.Count)})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	switch opts.by {
+	case "year":
+		printYearHistogram(w, comicsByYear(index))
+		return nil
+	case "terms", "words":
+		heading := "Most common title words"
+		if opts.by == "words" {
+			heading = "Most common transcript words"
+		}
+		fmt.Fprintln(w, colorize(heading, ansiBold))
+		for i, tc := range counts {
+			fmt.Fprintf(w, "%2d. %-20s %d\n", i+1, tc.Term, tc.Count)
+		}
+		return nil
+	}
+
+	fmt.Fprintln(w, colorize("XKCD Index Statistics", ansiBold))
+	fmt.Fprintln(w, colorize("═══════════════════════", ansiBold))
+	fmt.Fprintf(w, "Total comics indexed: %d\n", len(index.Comics))
+	fmt.Fprintf(w, "Last comic number:    %d\n", index.LastNum)
+	fmt.Fprintf(w, "Last updated:         %s\n", index.Updated.Format("2006-01-02 15:04:05"))
+	
+	if len(index.Comics) > 0 {
+		fmt.Fprintf(w, "\nSample comics:\n")
+		// Display oldest and latest 5 comics
+		var nums []int
+		for num := range index.Comics {
+			nums = append(nums, num)
+		}
+		sort.Ints(nums)
+
+		count := 0
+		for _, num := range nums {
+			if count >= 5 {
+				break
+			}
+			comic := index.Comics[num]
+			fmt.Fprintf(w, "  #%d: %s\n", num, comic.Title)
+			count++
+		}
+
+		if len(nums) > 10 {
+			fmt.Fprintf(w, "  ...\n")
+			for i := len(nums) - 5; i < len(nums); i++ {
+				num := nums[i]
+				comic := index.Comics[num]
+				fmt.Fprintf(w, "  #%d: %s\n", num, comic.Title)
+			}
+		}
+	}
+	return nil
+}
+
+// comicsByYear counts the indexed comics per publication year
+func comicsByYear(index *Index) map[string]int {
+	counts := make(map[string]int)
+	for _, comic := range index.Comics {
+		year := "unknown"
+		if date, err := comic.Date(); err == nil {
+			year = strconv.Itoa(date.Year())
+		}
+		counts[year]++
+	}
+	return counts
+}
+
+// histogramWidth is the length of the longest bar in printYearHistogram
+const histogramWidth = 40
+
+func printYearHistogram(w io.Writer, counts map[string]int) {
+	fmt.Fprintln(w, colorize("Comics per year", ansiBold))
+	most := 0
+	for _, count := range counts {
+		most = max(most, count)
+	}
+	for _, year := range slices.Sorted(maps.Keys(counts)) {
+		bar := strings.Repeat("█", max(1, counts[year]*histogramWidth/most))
+		fmt.Fprintf(w, "%-7s %s %d\n", year, colorize(bar, ansiCyan), counts[year])
+	}
+}
+
+// stopwords are common English words that say nothing about a comic's
+// topic; word statistics leave them out
+var stopwords = map[string]bool{
+	"a": true, "about": true, "after": true, "all": true, "an": true, "and": true,
+	"are": true, "as": true, "at": true, "be": true, "but": true, "by": true,
+	"can": true, "do": true, "for": true, "from": true, "has": true, "have": true,
+	"he": true, "her": true, "his": true, "how": true, "i": true, "if": true,
+	"in": true, "into": true, "is": true, "it": true, "its": true, "me": true,
+	"my": true, "no": true, "not": true, "of": true, "on": true, "or": true,
+	"our": true, "out": true, "she": true, "so": true, "than": true, "that": true,
+	"the": true, "their": true, "them": true, "then": true, "there": true, "they": true,
+	"this": true, "to": true, "up": true, "was": true, "we": true, "what": true,
+	"when": true, "who": true, "why": true, "will": true, "with": true, "you": true,
+	"your": true,
+}
+
+// titleTerms and transcriptWords are the word sources of topTerms
+func titleTerms(comic *Comic) []string {
+	return words(comic.Title)
+}
+
+// altTextNote is the copy of the alt text many transcripts end with,
+// which would make "title" and "text" the most common transcript words
+var altTextNote = regexp.MustCompile(`(?is)\{\{\s*(title|alt)[ -]text:.*?\}\}`)
+
+func transcriptWords(comic *Comic) []string {
+	return words(altTextNote.ReplaceAllString(comic.Transcript, ""))
+}
+
+// topTerms returns the n most frequent words from source across the
+// comics in dates (0 = all words), ignoring stopwords, numbers and single
+// letters. Ties are alphabetical.
+func topTerms(index *Index, n int, dates dateRange, source func(*Comic) []string) []TermCount {
+	counts := make(map[string]int)
+	for _, comic := range index.Comics {
+		if !dates.contains(comic) {
+			continue
+		}
+		for _, word := range source(comic) {
+			if _, err := strconv.Atoi(word); err == nil || utf8.RuneCountInString(word) < 2 || stopwords[word] {
+				continue
+			}
+			counts[word]++
+		}
+	}
+
+	terms := make([]TermCount, 0, len(counts))
+	for term, count := range counts {
+		terms = append(terms, TermCount{Term: term, Count: count})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Count != terms[j].Count {
+			return terms[i].Count > terms[j].Count
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	if n > 0 && n < len(terms) {
+		terms = terms[:n]
+	}
+	return terms
+}
+
+// newRand returns a random source seeded with seed, or from the clock when
+// seed is 0, so a fixed -seed makes the selection reproducible
+func newRand(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// randomFilter narrows the comics random picks from; the zero value
+// allows every comic
+type randomFilter struct {
+	query string		// Only comics matching this search query
+	dates dateRange		// Only comics published in this range
+}
+
+func showRandom(w io.Writer, store Store, rng *rand.Rand, filter randomFilter) error {
+	comic, err := pickRandom(store, rng, filter)
+	if err != nil {
+		return err
+	}
+	recordViews(store, comic.Num)
+
+	if *jsonFlag {
+		return printJSON(w, comic)
+	}
+
+	fmt.Fprintln(w, "Random XKCD Comic:")
+	displayComic(w, comic, nil)
+
+	return nil
+}
+
+// pickRandom selects a random comic among those the filter allows
+func pickRandom(store Store, rng *rand.Rand, filter randomFilter) (*Comic, error) {
+	index, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(index.Comics) == 0 {
+		return nil, fmt.Errorf("index is empty. Please run 'update' first")
+	}
+
+	// Fetch random comics. Sorting first keeps a seeded pick independent of
+	// map iteration order
+	var nums []int
+	if filter.query != "" {
+		results, err := search(store, filter.query, searchOptions{dates: filter.dates})
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			nums = append(nums, result.Comic.Num)
+		}
+	} else {
+		for num, comic := range index.Comics {
+			if filter.dates.contains(comic) {
+				nums = append(nums, num)
+			}
+		}
+	}
+	if len(nums) == 0 {
+		return nil, fmt.Errorf("no comics match the given filters")
+	}
+	sort.Ints(nums)
+
+	return index.Comics[nums[rng.Intn(len(nums))]], nil
+}
+
+// listComics prints one line per indexed comic in the date range, in
+// comic number order
+func listComics(w io.Writer, store Store, dates dateRange) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var nums []int
+	for num, comic := range index.Comics {
+		if dates.contains(comic) {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+
+	for _, num := range nums {
+		comic := index.Comics[num]
+		fmt.Fprintf(w, "#%-5d %s  %s\n", num, formatDate(comic), comic.Title)
+	}
+	fmt.Fprintf(w, "\n%d comics\n", len(nums))
+	return nil
+}
+
+// formatDate renders a comic's publication date as YYYY-MM-DD
+func formatDate(comic *Comic) string {
+	date, err := comic.Date()
+	if err != nil {
+		return "????-??-??"
+	}
+	return date.Format("2006-01-02")
+}
+
+// comicURL is the address of a comic's page on xkcd.com
+func comicURL(num int) string {
+	return fmt.Sprintf("%s%d/", baseURL, num)
+}
+
+// explainURL is a comic's page on the explainxkcd.com community wiki
+func explainURL(num int) string {
+	return fmt.Sprintf("%sindex.php/%d", explainBase, num)
+}
+
+// explainComic shows an indexed comic followed by its explainxkcd link,
+// optionally opening the explanation in the browser
+func explainComic(store Store, arg string, open bool) error {
+	num, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+	if err != nil {
+		return fmt.Errorf("invalid comic number: %s", arg)
+	}
+
+	comic, exists, err := store.Get(num)
+	if err != nil {
+		return err
+	}
+	if exists {
+		displayComic(os.Stdout, comic, nil)
+		fmt.Println()
+	} else {
+		warnf("comic #%d is not in the index\n", num)
+	}
+
+	if open {
+		openURL(explainURL(num))
+	} else {
+		fmt.Printf("Explanation: %s\n", explainURL(num))
+	}
+	return nil
+}
+
+// openComic opens a comic in the default browser: "random" picks one from
+// the index, anything else is a comic number
+func openComic(store Store, arg string, rng *rand.Rand) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var num int
+	if arg == "random" {
+		if len(index.Comics) == 0 {
+			return fmt.Errorf("index is empty. Please run 'update' first")
+		}
+		var nums []int
+		for n := range index.Comics {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		num = nums[rng.Intn(len(nums))]
+	} else if num, err = strconv.Atoi(strings.TrimPrefix(arg, "#")); err != nil {
+		return fmt.Errorf("invalid comic number: %s", arg)
+	}
+	if _, exists := index.Comics[num]; !exists {
+		warnf("comic #%d is not in the index\n", num)
+	}
+
+	recordViews(store, num)
+	openURL(comicURL(num))
+	return nil
+}
+
+// openURL launches the platform's URL opener. Without a desktop to open
+// it in, or if the opener fails, it prints the URL instead.
+func openURL(target string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+	default:
+		if os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != "" {
+			cmd = exec.Command("xdg-open", target)
+		}
+	}
+
+	if cmd != nil {
+		if err := cmd.Start(); err == nil {
+			fmt.Printf("Opening %s\n", target)
+			return
+		}
+	}
+	fmt.Println(target)
+}
+
+// browsePageSize is the number of comics listed per page by browse
+const browsePageSize = 20
+
+// browse is an interactive, line-based comic browser reading commands
+// from in: page through the comics (newest first), filter them with a
+// search query, and open one by typing its number
+func browse(store Store, in io.Reader) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if len(index.Comics) == 0 {
+		return fmt.Errorf("index is empty. Please run 'update' first")
+	}
+
+	// Searching the loaded index lets each search reuse its lowercased
+	// text and word index
+	store = loadedStore{Store: store, index: index}
+
+	var all []*Comic
+	for _, comic := range index.Comics {
+		all = append(all, comic)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Num > all[j].Num
+	})
+
+	list, page, query := all, 0, ""
+	var hl *highlighter
+	printPage := func() {
+		pages := (len(list) + browsePageSize - 1) / browsePageSize
+		start := page * browsePageSize
+		end := min(start+browsePageSize, len(list))
+		fmt.Println()
+		if query != "" {
+			fmt.Printf("%d comics matching '%s'", len(list), query)
+		} else {
+			fmt.Printf("%d comics", len(list))
+		}
+		if len(list) == 0 {
+			fmt.Println()
+			return
+		}
+		fmt.Printf(", page %d/%d:\n", page+1, pages)
+		for _, comic := range list[start:end] {
+			fmt.Printf("  %s %s  %s\n", colorize(fmt.Sprintf("#%-5d", comic.Num), ansiCyan),
+				formatDate(comic), hl.apply(comic.Title))
+		}
+	}
+	printHelp := func() {
+		fmt.Println("Commands:")
+		fmt.Println("  <number>       - Show that comic")
+		fmt.Println("  o <number>     - Open that comic in the browser")
+		fmt.Println("  /<query>       - Only list comics matching the search query (/ alone lists all)")
+		fmt.Println("  n or Enter, p  - Next or previous page")
+		fmt.Println("  q              - Quit")
+	}
+
+	printHelp()
+	printPage()
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Print("\nbrowse> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "q" || line == "quit":
+			return nil
+		case line == "" || line == "n":
+			if (page+1)*browsePageSize < len(list) {
+				page++
+			}
+			printPage()
+		case line == "p":
+			if page > 0 {
+				page--
+			}
+			printPage()
+		case line == "?" || line == "h" || line == "help":
+			printHelp()
+		case strings.HasPrefix(line, "o "):
+			num, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(line[2:]), "#"))
+			if err != nil {
+				fmt.Printf("Invalid comic number: %s\n", line[2:])
+				break
+			}
+			openURL(comicURL(num))
+		case strings.HasPrefix(line, "/"):
+			query = strings.TrimSpace(line[1:])
+			list, page, hl = all, 0, nil
+			if query != "" {
+				results, err := search(store, query, searchOptions{})
+				if err != nil {
+					fmt.Printf("Search failed: %v\n", err)
+					list, query = all, ""
+					break
+				}
+				list = nil
+				for _, result := range results {
+					list = append(list, result.Comic)
+				}
+				hl = newHighlighter(query, searchOptions{})
+			}
+			printPage()
+		default:
+			num, err := strconv.Atoi(strings.TrimPrefix(line, "#"))
+			if err != nil {
+				fmt.Printf("Unknown command %q; type ? for help\n", line)
+				break
+			}
+			comic, exists := index.Comics[num]
+			if !exists {
+				fmt.Printf("Comic #%d is not in the index\n", num)
+				break
+			}
+			displayComic(os.Stdout, comic, hl)
+		}
+	}
+}
+
+// rawTerminal switches the terminal on stdin to raw mode, so that keys
+// arrive one at a time without echo, and returns the function that
+// restores the previous settings
+func rawTerminal() (restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	saved, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("can't switch the terminal to raw mode: %v", err)
+	}
+	return func() { term.Restore(fd, saved) }, nil
+}
+
+// terminalSize reports the rows and columns of the terminal, or zeros if
+// there is none. stdout may be piped into a pager, so stderr and stdin
+// are asked too.
+func terminalSize() (rows, cols int) {
+	for _, f := range []*os.File{os.Stdout, os.Stderr, os.Stdin} {
+		if cols, rows, err := term.GetSize(int(f.Fd())); err == nil {
+			return rows, cols
+		}
+	}
+	return 0, 0
+}
+
+// readKeys sends the keys read from r to keys, named as in tui.handleKey:
+// a printable character as itself, special keys by name. It closes keys
+// when r ends. An escape sequence is expected to arrive in one read, as a
+// terminal sends it.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	sequences := map[string]string{
+		"A": "up", "B": "down", "C": "right", "D": "left", "H": "home", "F": "end",
+		"1~": "home", "7~": "home", "4~": "end", "8~": "end", "5~": "pgup", "6~": "pgdn",
+	}
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		for data := buf[:n]; len(data) > 0; {
+			switch {
+			case data[0] == 0x1b && len(data) > 2 && (data[1] == '[' || data[1] == 'O'):
+				// CSI or SS3: parameters, then a final byte from @ to ~
+				end := 2
+				for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+					end++
+				}
+				end = min(end+1, len(data))
+				if key, ok := sequences[string(data[2:end])]; ok {
+					keys <- key
+				}
+				data = data[end:]
+				continue
+			case data[0] == 0x1b:
+				keys <- "esc"
+			case data[0] == '\r' || data[0] == '\n':
+				keys <- "enter"
+			case data[0] == 0x7f || data[0] == 0x08:
+				keys <- "backspace"
+			case data[0] == 0x03 || data[0] == 0x04:
+				keys <- "ctrl-c"
+			case data[0] >= 0x20:
+				r, size := utf8.DecodeRune(data)
+				keys <- string(r)
+				data = data[size:]
+				continue
+			}
+			data = data[1:]
+		}
+	}
+}
+
+// tui is the state of the full-screen browser: a list of comics on the
+// left, filtered by a search, and the selected comic on the right
+type tui struct {
+	store   Store
+	all     []*Comic		// Every comic, newest first
+	list    []*Comic		// The comics listed: all, or the matches of query
+	query   string
+	hl      *highlighter
+	sel     int				// Index in list of the selected comic
+	top     int				// Index in list of the first comic on screen
+	scroll  int				// First line of the details on screen
+	editing bool			// Typing a search query into input
+	input   []rune
+	status  string			// Message shown in the bottom line until the next key
+}
+
+// runTUI shows the full-screen browser until q is pressed. Without a
+// terminal it falls back to the line-based browse.
+func runTUI(store Store) error {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		warnf("tui needs a terminal; using the line-based browser instead\n")
+		return browse(store, os.Stdin)
+	}
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if len(index.Comics) == 0 {
+		return fmt.Errorf("index is empty. Please run 'update' first")
+	}
+	restore, err := rawTerminal()
+	if err != nil {
+		warnf("%v; using the line-based browser instead\n", err)
+		return browse(store, os.Stdin)
+	}
+	// Switch to the alternate screen and hide the cursor, so the shell's
+	// screen comes back as it was
+	fmt.Print("\033[?1049h\033[?25l")
+	defer func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		restore()
+	}()
+
+	t := &tui{store: loadedStore{Store: store, index: index}}
+	for _, comic := range index.Comics {
+		t.all = append(t.all, comic)
+	}
+	sort.Slice(t.all, func(i, j int) bool {
+		return t.all[i].Num > t.all[j].Num
+	})
+	t.list = t.all
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	// The size is checked again now and then, as there is no portable way
+	// to be told the terminal was resized
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		rows, cols := terminalSize()
+		rows, cols = max(rows, 5), max(cols, 40)
+		fmt.Print(t.draw(rows, cols))
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key, rows) {
+				return nil
+			}
+		case <-tick.C:
+		}
+	}
+}
+
+// handleKey applies one key and reports whether to keep running
+func (t *tui) handleKey(key string, rows int) bool {
+	t.status = ""
+	if t.editing {
+		switch key {
+		case "enter":
+			t.editing = false
+			t.filter(strings.TrimSpace(string(t.input)))
+		case "esc", "ctrl-c":
+			t.editing = false
+		case "backspace":
+			if len(t.input) > 0 {
+				t.input = t.input[:len(t.input)-1]
+			}
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				t.input = append(t.input, []rune(key)...)
+			}
+		}
+		return true
+	}
+
+	page := max(rows-3, 1)
+	switch key {
+	case "q", "ctrl-c":
+		return false
+	case "up", "k":
+		t.move(-1)
+	case "down", "j":
+		t.move(1)
+	case "pgup":
+		t.move(-page)
+	case "pgdn", " ":
+		t.move(page)
+	case "home", "g":
+		t.move(-len(t.list))
+	case "end", "G":
+		t.move(len(t.list))
+	case "left", "h":
+		t.scroll = max(t.scroll-page/2, 0)
+	case "right", "l":
+		t.scroll += page / 2
+	case "/":
+		t.editing, t.input = true, []rune(t.query)
+	case "esc":
+		if t.query != "" {
+			t.filter("")
+		}
+	case "enter", "o":
+		if len(t.list) > 0 {
+			comic := t.list[t.sel]
+			recordViews(t.store, comic.Num)
+			openURL(comicURL(comic.Num))
+			t.status = "Opened " + comicURL(comic.Num)
+		}
+	case "?":
+		t.status = "↑/↓ move  PgUp/PgDn page  ←/→ scroll details  / search  Esc clear  Enter open  q quit"
+	}
+	return true
+}
+
+// move moves the selection by delta comics, staying within the list
+func (t *tui) move(delta int) {
+	if len(t.list) == 0 {
+		return
+	}
+	sel := min(max(t.sel+delta, 0), len(t.list)-1)
+	if sel != t.sel {
+		t.sel, t.scroll = sel, 0
+	}
+}
+
+// filter lists the comics matching query, best first, or all of them
+// for an empty query
+func (t *tui) filter(query string) {
+	t.query, t.list, t.hl = "", t.all, nil
+	t.sel, t.top, t.scroll = 0, 0, 0
+	if query == "" {
+		return
+	}
+	results, err := search(t.store, query, searchOptions{})
+	if err != nil {
+		t.status = "Search failed: " + err.Error()
+		return
+	}
+	t.query, t.list = query, nil
+	for _, result := range results {
+		t.list = append(t.list, result.Comic)
+	}
+	t.hl = newHighlighter(query, searchOptions{})
+}
+
+// draw renders the whole screen, rows by cols, as one string. In raw mode
+// a line feed doesn't return the cursor, so lines end with \r\n.
+func (t *tui) draw(rows, cols int) string {
+	listWidth := min(max(cols*2/5, 20), 50)
+	detailWidth := cols - listWidth - 3
+	body := rows - 2
+
+	// Keep the selection on screen
+	if t.sel < t.top {
+		t.top = t.sel
+	} else if t.sel >= t.top+body {
+		t.top = t.sel - body + 1
+	}
+
+	var left []string
+	for i := t.top; i < len(t.list) && len(left) < body; i++ {
+		comic := t.list[i]
+		line := fitWidth(fmt.Sprintf("#%-5d %s", comic.Num, comic.Title), listWidth)
+		if i == t.sel {
+			line = "\033[7m" + line + "\033[27m"
+		}
+		left = append(left, line)
+	}
+
+	var right []string
+	if len(t.list) > 0 {
+		right = t.details(t.list[t.sel], detailWidth)
+		t.scroll = min(t.scroll, max(len(right)-body, 0))
+		right = right[t.scroll:]
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\033[H")
+	header := fmt.Sprintf("xkcd: %d comics", len(t.all))
+	if t.query != "" {
+		header = fmt.Sprintf("xkcd: %d comics matching '%s'", len(t.list), t.query)
+	}
+	sb.WriteString(colorize(fitWidth(header, cols), ansiBold) + "\033[K\r\n")
+	for i := 0; i < body; i++ {
+		l, r := "", ""
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		sb.WriteString(l + strings.Repeat(" ", max(listWidth-visibleWidth(l), 0)) + " │ " + r + "\033[K\r\n")
+	}
+
+	footer := colorize(fitWidth(valueOr(t.status, "↑/↓ move  / search  Enter open  ? help  q quit"), cols), ansiDim)
+	if t.editing {
+		footer = "Search: " + string(t.input) + "\033[7m \033[27m"
+	}
+	sb.WriteString(footer + "\033[K")
+	return sb.String()
+}
+
+// details lays out a comic for the right pane, wrapped to width
+func (t *tui) details(comic *Comic, width int) []string {
+	title := fmt.Sprintf("#%d: %s", comic.Num, comic.Title)
+	if favorites[comic.Num] {
+		title += " ★"
+	}
+	var lines []string
+	for _, line := range wrapText(title, width) {
+		lines = append(lines, colorize(t.hl.apply(line), ansiBold))
+	}
+	for _, detail := range comicDetails(comic) {
+		lines = append(lines, fitWidth(strings.TrimSpace(detail.label)+" "+detail.value, width))
+	}
+	section := func(heading, text string) {
+		if text == "" {
+			return
+		}
+		lines = append(lines, "", colorize(heading, ansiCyan))
+		for _, line := range wrapText(text, width) {
+			lines = append(lines, t.hl.apply(line))
+		}
+	}
+	section("Alt text", comic.Alt)
+	section("Transcript", comic.Transcript)
+	return lines
+}
+
+// fitWidth cuts text to at most width runes, ending it with "…" if cut
+func fitWidth(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	if width < 1 {
+		return ""
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// printJSON writes v to w as indented JSON, for -json mode
+func printJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// exportSelection returns the comics to export: the comics named by spec
+// (see parseComicNumbers), else the matches of query in ranked order, else
+// the whole index in comic number order
+func exportSelection(store Store, query, spec string) ([]*Comic, error) {
+	if spec != "" {
+		nums, err := parseComicNumbers(spec)
+		if err != nil {
+			return nil, err
+		}
+		index, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+
+		var comics []*Comic
+		var missing []int
+		for _, num := range nums {
+			if comic, exists := index.Comics[num]; exists {
+				comics = append(comics, comic)
+			} else {
+				missing = append(missing, num)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("not found in index: %s", formatNums(missing))
+		}
+		return comics, nil
+	}
+
+	if query != "" {
+		results, err := search(store, query, searchOptions{})
+		if err != nil {
+			return nil, err
+		}
+		comics := make([]*Comic, len(results))
+		for i, result := range results {
+			comics[i] = result.Comic
+		}
+		return comics, nil
+	}
+
+	index, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	comics := make([]*Comic, 0, len(index.Comics))
+	for _, comic := range index.Comics {
+		comics = append(comics, comic)
+	}
+	sort.Slice(comics, func(i, j int) bool {
+		return comics[i].Num < comics[j].Num
+	})
+	return comics, nil
+}
+
+// exportOptions holds the flags of the export command
+type exportOptions struct {
+	format  string
+	query   string	// Only export search matches
+	spec    string	// Only export these comic numbers
+	outPath string	// "" writes to stdout
+	limit   int		// Export at most this many comics; 0 for all
+}
+
+// exportComics writes the selected comics in the given format to
+// opts.outPath, or to stdout
+func exportComics(store Store, opts exportOptions) error {
+	format, outPath := opts.format, opts.outPath
+	comics, err := exportSelection(store, opts.query, opts.spec)
+	if err != nil {
+		return err
+	}
+	// A feed lists the newest comics, whatever the selection's order
+	if format == "rss" {
+		sort.Slice(comics, func(i, j int) bool {
+			return newer(comics[i], comics[j])
+		})
+	}
+	if opts.limit > 0 && len(comics) > opts.limit {
+		comics = comics[:opts.limit]
+	}
+
+	// A gallery is a directory of pages rather than a single stream
+	if format == "html" {
+		if outPath == "" {
+			return fmt.Errorf("the html format needs -o, the directory to write the gallery to")
+		}
+		if err := exportHTML(outPath, comics); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d comics to %s\n", len(comics), filepath.Join(outPath, "index.html"))
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "csv":
+		err = exportCSV(w, comics)
+	case "ndjson":
+		err = exportNDJSON(w, comics)
+	case "rss":
+		err = exportRSS(w, comics)
+	case "md":
+		for i, comic := range comics {
+			if i > 0 {
+				fmt.Fprint(w, "\n---\n\n")
+			}
+			if _, err = io.WriteString(w, renderMarkdown(comic)); err != nil {
+				break
+			}
+		}
+	default:
+		return fmt.Errorf("unknown export format %q (supported: csv, ndjson, md, html, rss)", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if outPath != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d comics to %s\n", len(comics), outPath)
+	}
+	return nil
+}
+
+// exportCSV writes a header and one row per comic. csv.Writer quotes any
+// field containing commas, quotes or newlines, as transcripts often do.
+func exportCSV(w io.Writer, comics []*Comic) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"num", "date", "title", "alt", "transcript", "img", "link"})
+	for _, comic := range comics {
+		date := ""
+		if d, err := comic.Date(); err == nil {
+			date = d.Format("2006-01-02")
+		}
+		cw.Write([]string{
+			strconv.Itoa(comic.Num), date, comic.Title, comic.Alt,
+			comic.Transcript, comic.Img, comic.Link,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportNDJSON writes one compact JSON object per comic and line, encoding
+// each straight to w instead of marshaling the whole selection at once
+func exportNDJSON(w io.Writer, comics []*Comic) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, comic := range comics {
+		if err := enc.Encode(comic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rssFeed is an RSS 2.0 document; encoding/xml escapes the text fields
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate,omitempty"`	// RFC 1123, omitted without a valid date
+	Description string `xml:"description"`
+}
+
+// exportRSS writes the comics as an RSS 2.0 feed, one item per comic with
+// the alt text as its description
+func exportRSS(w io.Writer, comics []*Comic) error {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       "xkcd",
+			Link:        baseURL,
+			Description: "Comics from the local xkcd index",
+		},
+	}
+	for _, comic := range comics {
+		item := rssItem{
+			Title:       comic.Title,
+			Link:        comicURL(comic.Num),
+			GUID:        comicURL(comic.Num),
+			Description: comic.Alt,
+		}
+		if date, err := comic.Date(); err == nil {
+			item.PubDate = date.Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// galleryComic is what the HTML gallery templates show of a comic
+type galleryComic struct {
+	*Comic
+	Date       string
+	Page       string	// File name of the comic's own page
+	Image      string	// Copied cached image, or the remote URL
+	URL        string
+	Prev, Next string	// Neighboring pages, "" at either end
+}
+
+var galleryIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>xkcd gallery</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+ul { list-style: none; padding: 0; display: grid; grid-template-columns: repeat(auto-fill, minmax(180px, 1fr)); gap: 1em; }
+li a { display: block; color: inherit; text-decoration: none; }
+li img { width: 100%; height: 140px; object-fit: contain; background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>xkcd gallery</h1>
+<p>{{len .}} comics</p>
+<ul>
+{{range .}}<li><a href="{{.Page}}">{{if .Image}}<img src="{{.Image}}" alt="{{.Title}}" loading="lazy">{{end}}<div>#{{.Num}}: {{.Title}}</div><small>{{.Date}}</small></a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+var galleryPage = template.Must(template.New("comic").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>xkcd #{{.Num}}: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; }
+img { max-width: 100%; }
+pre { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<nav>{{if .Prev}}<a href="{{.Prev}}">&larr; previous</a> | {{end}}<a href="index.html">all comics</a>{{if .Next}} | <a href="{{.Next}}">next &rarr;</a>{{end}}</nav>
+<h1>#{{.Num}}: {{.Title}}</h1>
+<p>Published {{.Date}} &middot; <a href="{{.URL}}">{{.URL}}</a></p>
+{{if .Image}}<p><img src="{{.Image}}" alt="{{.Title}}" title="{{.Alt}}"></p>{{end}}
+{{if .Alt}}<blockquote>{{.Alt}}</blockquote>{{end}}
+{{if .Transcript}}<h2>Transcript</h2>
+<pre>{{.Transcript}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// exportHTML writes a static gallery to dir: index.html with a thumbnail
+// of every comic, and a <num>.html page per comic. Cached images are
+// copied to dir/images so the gallery works offline; comics without one
+// link to the image on xkcd.com.
+func exportHTML(dir string, comics []*Comic) error {
+	if err := os.MkdirAll(filepath.Join(dir, imagesDir), 0755); err != nil {
+		return err
+	}
+
+	pages := make([]*galleryComic, len(comics))
+	for i, comic := range comics {
+		page := &galleryComic{
+			Comic: comic,
+			Date:  formatDate(comic),
+			Page:  fmt.Sprintf("%d.html", comic.Num),
+			Image: comic.Img,
+			URL:   comicURL(comic.Num),
+		}
+		if cached := cachedImage(comic); cached != "" {
+			data, err := os.ReadFile(cached)
+			if err != nil {
+				return err
+			}
+			name := filepath.Base(cached)
+			if err := os.WriteFile(filepath.Join(dir, imagesDir, name), data, 0644); err != nil {
+				return err
+			}
+			page.Image = imagesDir + "/" + name
+		}
+		pages[i] = page
+	}
+	for i, page := range pages {
+		if i > 0 {
+			page.Prev = pages[i-1].Page
+		}
+		if i+1 < len(pages) {
+			page.Next = pages[i+1].Page
+		}
+		if err := writeTemplate(filepath.Join(dir, page.Page), galleryPage, page); err != nil {
+			return err
+		}
+	}
+	return writeTemplate(filepath.Join(dir, "index.html"), galleryIndex, pages)
+}
+
+func writeTemplate(path string, tmpl *template.Template, data any) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// renderMarkdown renders a comic as a standalone Markdown document
+func renderMarkdown(comic *Comic) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", comic.Title)
+	date := "unknown date"
+	if d, err := comic.Date(); err == nil {
+		date = d.Format("2006-01-02")
+	}
+	fmt.Fprintf(&b, "*xkcd #%d, published %s* — <%s%d/>\n\n", comic.Num, date, baseURL, comic.Num)
+
+	if comic.Img != "" {
+		// Brackets would end the image description early
+		alt := strings.NewReplacer("[", "\\[", "]", "\\]").Replace(comic.Title)
+		fmt.Fprintf(&b, "![%s](%s)\n\n", alt, comic.Img)
+	}
+
+	if comic.Alt != "" {
+		for _, line := range strings.Split(comic.Alt, "\n") {
+			fmt.Fprintf(&b, "> %s\n", line)
+		}
+		b.WriteString("\n")
+	}
+
+	if comic.Transcript != "" {
+		// The fence must be longer than any backtick run in the transcript
+		fence := "```"
+		for strings.Contains(comic.Transcript, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&b, "## Transcript\n\n%s\n%s\n%s\n", fence, comic.Transcript, fence)
+	}
+	return b.String()
+}
+
+// parseComicNumbers expands a comic selection: a single number ("353"), a
+// comma-separated list ("5,17,353"), an inclusive range ("100-110"), or
+// any mix of them ("1-3,10")
+func parseComicNumbers(spec string) ([]int, error) {
+	var nums []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if from, to, isRange := strings.Cut(part, "-"); isRange {
+			start, err1 := strconv.Atoi(from)
+			end, err2 := strconv.Atoi(to)
+			if err1 != nil || err2 != nil || start > end {
+				return nil, fmt.Errorf("invalid comic range: %s", part)
+			}
+			// Checked before expanding, so a typo like 1-999999999 fails
+			// at once instead of allocating a number for each comic
+			if end-start >= maxComicSelection-len(nums) {
+				return nil, fmt.Errorf("comic range %s is too large (at most %d comics at a time)", part, maxComicSelection)
+			}
+			for num := start; num <= end; num++ {
+				nums = append(nums, num)
+			}
+			continue
+		}
+
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid comic number: %s", part)
+		}
+		nums = append(nums, num)
+	}
+	return nums, nil
+}
+
+// latestComic is the highest-numbered comic in the index, or nil if the
+// index is empty
+func latestComic(index *Index) *Comic {
+	var latest *Comic
+	for num, comic := range index.Comics {
+		if latest == nil || num > latest.Num {
+			latest = comic
+		}
+	}
+	return latest
+}
+
+// showLatest displays the newest indexed comic without touching the
+// network. With a fetcher it instead asks xkcd.com for the current comic
+// and adds it to the index.
+func showLatest(ctx context.Context, store Store, opts showOptions) error {
+	f := opts.fetcher
+	var comic *Comic
+	if f != nil {
+		latest, err := f.fetchComic(ctx, 0)
+		if err != nil {
+			return fmt.Errorf("failed to fetch latest comic: %v", err)
+		}
+		if err := storeComic(store, latest, "show"); err != nil {
+			warnf("failed to add comic #%d to the index: %v\n", latest.Num, err)
+		}
+		comic = latest
+	} else {
+		index, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if comic = latestComic(index); comic == nil {
+			return fmt.Errorf("the index is empty; run 'update' first")
+		}
+	}
+
+	recordViews(store, comic.Num)
+	if *jsonFlag {
+		return printJSON(opts.out, comic)
+	}
+	return opts.display(comic)
+}
+
+// notIndexedError reports that comic num isn't indexed, suggesting the
+// nearest comics that are
+func notIndexedError(store Store, num int) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	nearest := nearestIndexed(index, num)
+	if len(nearest) == 0 {
+		return fmt.Errorf("comic #%d not found in index (use -online to fetch it)", num)
+	}
+	var list []string
+	for _, n := range nearest {
+		list = append(list, fmt.Sprintf("#%d", n))
+	}
+	return fmt.Errorf("comic #%d not found in index; nearest indexed: %s (use -online to fetch it)", num, strings.Join(list, ", "))
+}
+
+// nearestIndexed returns the closest indexed comics below and above num,
+// whichever exist, in order
+func nearestIndexed(index *Index, num int) []int {
+	below, above := 0, 0
+	for n := range index.Comics {
+		if n < num && n > below {
+			below = n
+		}
+		if n > num && (above == 0 || n < above) {
+			above = n
+		}
+	}
+	var nearest []int
+	for _, n := range []int{below, above} {
+		if n > 0 {
+			nearest = append(nearest, n)
+		}
+	}
+	return nearest
+}
+
+// showAdjacent shows the nearest indexed comic after (step 1) or before
+// (step -1) arg, skipping gaps such as #404. An empty arg steps from the
+// comic viewed last.
+func showAdjacent(store Store, arg string, step int, opts showOptions) error {
+	var num int
+	if arg == "" {
+		entries, err := store.LoadHistory()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("no comics viewed yet; give a comic number")
+		}
+		num = entries[len(entries)-1].Num
+	} else {
+		var err error
+		if num, err = strconv.Atoi(strings.TrimPrefix(arg, "#")); err != nil {
+			return fmt.Errorf("invalid comic number: %s", arg)
+		}
+	}
+
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	var comic *Comic
+	for n, c := range index.Comics {
+		if (n-num)*step > 0 && (comic == nil || (n-comic.Num)*step < 0) {
+			comic = c
+		}
+	}
+	if comic == nil {
+		if step > 0 {
+			return fmt.Errorf("no indexed comic after #%d", num)
+		}
+		return fmt.Errorf("no indexed comic before #%d", num)
+	}
+
+	recordViews(store, comic.Num)
+	if *jsonFlag {
+		return printJSON(opts.out, comic)
+	}
+	return opts.display(comic)
+}
+
+// showOptions holds the flags of the show command
+type showOptions struct {
+	hl      *highlighter	// Highlights these search terms
+	fetcher *fetcher		// Fetches comics missing from the index; nil stays offline
+	image   bool			// Also render the cached image
+	out     io.Writer		// Where comics are written
+	format  *texttemplate.Template	// Replaces displayComic when set
+}
+
+// display shows a comic, followed by its image with -image, or prints it
+// with the -format template
+func (opts showOptions) display(comic *Comic) error {
+	if opts.format != nil {
+		return printFormatted(opts.out, opts.format, comic)
+	}
+	displayComic(opts.out, comic, opts.hl)
+	if !opts.image {
+		return nil
+	}
+
+	local := cachedImage(comic)
+	if local == "" {
+		warnf("the image of comic #%d isn't cached; run 'images' first\n", comic.Num)
+		return nil
+	}
+	lines, err := renderImage(local, displayWidth()+4, shouldColor())
+	if err != nil {
+		warnf("can't render %s: %v\n", local, err)
+		return nil
+	}
+	for _, line := range lines {
+		fmt.Fprintln(opts.out, line)
+	}
+	return nil
+}
+
+// parseFormat compiles a -format template, e.g. "{{.Num}}: {{.Title}}"
+func parseFormat(text string) (*texttemplate.Template, error) {
+	tmpl, err := texttemplate.New("format").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -format template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// printFormatted executes a -format template for data and writes the
+// result followed by a newline, unless it ends with one. Nothing is
+// written if the template fails halfway.
+func printFormatted(w io.Writer, tmpl *texttemplate.Template, data any) error {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return fmt.Errorf("-format: %v", err)
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// asciiRamp maps brightness to characters, from black ink to white paper
+const asciiRamp = "@%#*+=-:. "
+
+// renderImage draws an image in the terminal, width columns wide. Each
+// character stands for two rows of pixels, since terminal cells are about
+// twice as tall as wide: with color, "▀" takes the upper pixel as its
+// foreground and the lower as its background; without, a character from
+// asciiRamp approximates the brightness.
+func renderImage(path string, width int, color bool) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, fmt.Errorf("image is empty")
+	}
+	width = min(width, bounds.Dx())
+	scale := float64(bounds.Dx()) / float64(width)
+	height := max(int(float64(bounds.Dy())/scale/2), 1)
+
+	// average is the mean color of the source pixels behind one half (or,
+	// without color, all) of the character cell at column x, row y
+	average := func(x int, y0, y1 float64) (r, g, b uint32) {
+		x0, x1 := int(float64(x)*scale), max(int(float64(x+1)*scale), int(float64(x)*scale)+1)
+		ys, ye := int(y0*scale), max(int(y1*scale), int(y0*scale)+1)
+		var n uint32
+		for py := ys; py < ye && py < bounds.Dy(); py++ {
+			for px := x0; px < x1 && px < bounds.Dx(); px++ {
+				pr, pg, pb, _ := img.At(bounds.Min.X+px, bounds.Min.Y+py).RGBA()
+				r, g, b, n = r+pr>>8, g+pg>>8, b+pb>>8, n+1
+			}
+		}
+		if n == 0 {
+			return 255, 255, 255
+		}
+		return r / n, g / n, b / n
+	}
+
+	lines := make([]string, 0, height)
+	for y := 0; y < height; y++ {
+		var line strings.Builder
+		for x := 0; x < width; x++ {
+			if color {
+				tr, tg, tb := average(x, float64(2*y), float64(2*y+1))
+				br, bg, bb := average(x, float64(2*y+1), float64(2*y+2))
+				fmt.Fprintf(&line, "\033[38;2;%d;%d;%dm\033[48;2;%d;%d;%dm▀", tr, tg, tb, br, bg, bb)
+				continue
+			}
+			r, g, b := average(x, float64(2*y), float64(2*y+2))
+			brightness := (299*r + 587*g + 114*b) / 1000
+			line.WriteByte(asciiRamp[int(brightness)*(len(asciiRamp)-1)/255])
+		}
+		if color {
+			line.WriteString(ansiReset)
+		}
+		lines = append(lines, line.String())
+	}
+	return lines, nil
+}
+
+// storeComic adds or replaces one comic in the index and saves it,
+// advancing LastNum only if no gap is left below the comic
+func storeComic(store Store, comic *Comic, command string) error {
+	return storeComics(store, []*Comic{comic}, command)
+}
+
+// storeComics adds or replaces several comics with a single save of the
+// index, which is rewritten whole however few comics change
+func storeComics(store Store, comics []*Comic, command string) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	var added, updated []int
+	limit := 0
+	for _, comic := range comics {
+		if _, exists := index.Comics[comic.Num]; exists {
+			updated = append(updated, comic.Num)
+		} else {
+			added = append(added, comic.Num)
+		}
+		index.Comics[comic.Num] = comic
+		limit = max(limit, comic.Num)
+	}
+	index.LastNum = contiguousLastNum(index, limit)
+	index.Updated = time.Now()
+
+	if err := store.Save(index); err != nil {
+		return err
+	}
+	recordAudit(store, command, added, updated, nil, index.LastNum)
+	return nil
+}
+
+// fetchMissing fetches a comic that isn't indexed yet and adds it to the
+// index, so the next lookup works offline
+func fetchMissing(ctx context.Context, store Store, f *fetcher, num int) (*Comic, error) {
+	comic, err := f.fetchComic(ctx, num)
+	if errors.Is(err, ErrComicNotFound) {
+		return nil, fmt.Errorf("comic #%d does not exist", num)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("comic #%d not found in index, and fetching it failed: %v", num, err)
+	}
+	if err := storeComic(store, comic, "show"); err != nil {
+		warnf("failed to add comic #%d to the index: %v\n", num, err)
+	}
+	return comic, nil
+}
+
+// showComics displays the comics in spec. With a fetcher, comics missing
+// from the index are fetched from xkcd.com and indexed.
+func showComics(ctx context.Context, store Store, spec string, opts showOptions) error {
+	f := opts.fetcher
+	nums, err := parseComicNumbers(spec)
+	if err != nil {
+		return err
+	}
+
+	if len(nums) == 1 {
+		comic, exists, err := store.Get(nums[0])
+		if err != nil {
+			return err
+		}
+		if !exists && f == nil {
+			return notIndexedError(store, nums[0])
+		}
+		if !exists {
+			if comic, err = fetchMissing(ctx, store, f, nums[0]); err != nil {
+				return err
+			}
+		}
+		recordViews(store, comic.Num)
+		if *jsonFlag {
+			return printJSON(opts.out, comic)
+		}
+		return opts.display(comic)
+	}
+
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	// Fetch every missing comic before indexing them all in one save
+	fetched := make(map[int]*Comic)
+	if f != nil {
+		var batch []*Comic
+		for _, num := range nums {
+			if _, exists := index.Comics[num]; exists {
+				continue
+			}
+			if comic, err := f.fetchComic(ctx, num); err == nil {
+				fetched[num] = comic
+				batch = append(batch, comic)
+			}
+		}
+		if len(batch) > 0 {
+			if err := storeComics(store, batch, "show"); err != nil {
+				warnf("failed to add the fetched comics to the index: %v\n", err)
+			}
+		}
+	}
+
+	var missing []int
+	var found []*Comic
+	for _, num := range nums {
+		comic, exists := index.Comics[num]
+		if !exists {
+			comic, exists = fetched[num]
+		}
+		if !exists {
+			missing = append(missing, num)
+			continue
+		}
+		found = append(found, comic)
+	}
+
+	var viewed []int
+	for _, comic := range found {
+		viewed = append(viewed, comic.Num)
+	}
+	recordViews(store, viewed...)
+
+	if *jsonFlag {
+		if err := printJSON(opts.out, found); err != nil {
+			return err
+		}
+	} else {
+		for i, comic := range found {
+			if i > 0 && opts.format == nil {
+				fmt.Fprintln(opts.out)
+			}
+			if err := opts.display(comic); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("not found in index: %s", formatNums(missing))
+	}
+	return nil
+}
+
+// loadedStore serves the index loaded once at startup instead of reading
+// the file for every request; everything else goes to the wrapped store
+type loadedStore struct {
+	Store
+	index *Index
+}
+
+func (s loadedStore) Load() (*Index, error) {
+	return s.index, nil
+}
+
+func (s loadedStore) Get(num int) (*Comic, bool, error) {
+	comic, exists := s.index.Comics[num]
+	return comic, exists, nil
+}
+
+// serve runs a small web app over the index until ctx is canceled, then
+// waits for requests in flight to finish: a read-only JSON API, the cached
+// images and an HTML gallery built on both. The index is loaded once at
+// startup; handlers only read it, so they share it without locking.
+func serve(ctx context.Context, store Store, addr string) error {
+	index, err := store.Load()
+	if err != nil {
+		return err
+	}
+	store = loadedStore{Store: store, index: index}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /comic/{num}", func(w http.ResponseWriter, r *http.Request) {
+		num, err := strconv.Atoi(r.PathValue("num"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError("invalid comic number %q", r.PathValue("num")))
+			return
+		}
+		comic, exists, err := store.Get(num)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError("%v", err))
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, apiError("comic #%d is not in the index", num))
+			return
+		}
+		writeJSON(w, http.StatusOK, comic)
+	})
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		query := params.Get("q")
+		if query == "" {
+			writeJSON(w, http.StatusBadRequest, apiError("the q parameter is required"))
+			return
+		}
+		limit := 10
+		if n := params.Get("n"); n != "" {
+			var convErr error
+			if limit, convErr = strconv.Atoi(n); convErr != nil {
+				writeJSON(w, http.StatusBadRequest, apiError("invalid n %q", n))
+				return
+			}
+		}
+		dates, err := newDateRange(params.Get("after"), params.Get("before"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError("%v", err))
+			return
+		}
+		results, err := search(store, query, searchOptions{dates: dates})
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError("%v", err))
+			return
+		}
+		if limit > 0 && len(results) > limit {
+			results = results[:limit]
+		}
+		writeJSON(w, http.StatusOK, append([]*SearchResult{}, results...))
+	})
+	mux.HandleFunc("GET /random", func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		dates, err := newDateRange(params.Get("after"), params.Get("before"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError("%v", err))
+			return
+		}
+		// A rand.Rand isn't safe for concurrent use, so each request gets one
+		comic, err := pickRandom(store, newRand(0), randomFilter{query: params.Get("query"), dates: dates})
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, apiError("%v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, comic)
+	})
+	mux.HandleFunc("GET /images/{file}", func(w http.ResponseWriter, r *http.Request) {
+		// The extension is ignored: the cached image keeps the one of its
+		// URL, and /images/<num>.png finds it whatever it is
+		file := r.PathValue("file")
+		num, err := strconv.Atoi(strings.TrimSuffix(file, path.Ext(file)))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError("invalid image %q", file))
+			return
+		}
+		comic, exists, err := store.Get(num)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError("%v", err))
+			return
+		}
+		if !exists {
+			writeJSON(w, http.StatusNotFound, apiError("comic #%d is not in the index", num))
+			return
+		}
+		cached := cachedImage(comic)
+		if cached == "" {
+			writeJSON(w, http.StatusNotFound, apiError("the image of comic #%d hasn't been downloaded", num))
+			return
+		}
+		http.ServeFile(w, r, cached)
+	})
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, servePage)
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := IndexStats{
+			Total:   len(index.Comics),
+			LastNum: index.LastNum,
+			Updated: index.Updated,
+		}
+		switch by := r.URL.Query().Get("by"); by {
+		case "":
+		case "year":
+			stats.ByYear = comicsByYear(index)
+		case "terms":
+			stats.TopTerms = topTerms(index, topTermsCount, dateRange{}, titleTerms)
+		case "words":
+			stats.TopWords = topTerms(index, topTermsCount, dateRange{}, transcriptWords)
+		default:
+			writeJSON(w, http.StatusBadRequest, apiError("unknown breakdown %q (use year, terms or words)", by))
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		// Give requests in flight a moment to finish
+		timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(timeout)
+	}()
+
+	infof("Serving %d comics on http://%s/ (Ctrl-C to stop)\n", len(index.Comics), addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err := <-shutdown; err != nil {
+		return err
+	}
+	infof("Server stopped.\n")
+	return nil
+}
+
+// servePage is the gallery serve shows at /. It is a static page: the
+// comics are loaded from the JSON API, with the cached images from
+// /images and the ones not downloaded from xkcd.com.
+const servePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>xkcd gallery</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+ul { list-style: none; padding: 0; display: grid; grid-template-columns: repeat(auto-fill, minmax(180px, 1fr)); gap: 1em; }
+li a { display: block; color: inherit; text-decoration: none; }
+li img { width: 100%; height: 140px; object-fit: contain; background: #f4f4f4; }
+#comic img { max-width: 100%; }
+#comic pre { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>xkcd gallery</h1>
+<form id="search"><input name="q" type="search" placeholder="Search comics" autofocus> <button>Search</button></form>
+<p id="status"></p>
+<section id="comic" hidden></section>
+<ul id="comics"></ul>
+<script>
+const list = document.getElementById("comics");
+const status = document.getElementById("status");
+const detail = document.getElementById("comic");
+
+async function api(url) {
+  const resp = await fetch(url);
+  const body = await resp.json();
+  if (!resp.ok) throw new Error(body.error);
+  return body;
+}
+
+// The cached image if there is one, else the original on xkcd.com
+function image(c) {
+  const img = document.createElement("img");
+  img.src = "/images/" + c.num + ".png";
+  img.alt = c.title;
+  img.title = c.alt;
+  img.loading = "lazy";
+  img.onerror = () => { img.onerror = null; img.src = c.img; };
+  return img;
+}
+
+function el(tag, text) {
+  const e = document.createElement(tag);
+  e.textContent = text;
+  return e;
+}
+
+function showList(comics) {
+  list.replaceChildren(...comics.map(c => {
+    const a = document.createElement("a");
+    a.href = "#" + c.num;
+    a.append(image(c), el("div", "#" + c.num + ": " + c.title), el("small", [c.year, c.month.padStart(2, "0"), c.day.padStart(2, "0")].join("-")));
+    const li = document.createElement("li");
+    li.append(a);
+    return li;
+  }));
+}
+
+async function showComic(num) {
+  try {
+    const c = await api("/comic/" + num);
+    const link = el("a", "https://xkcd.com/" + c.num + "/");
+    link.href = link.textContent;
+    detail.replaceChildren(el("h2", "#" + c.num + ": " + c.title), link, el("p"), image(c), el("blockquote", c.alt));
+    if (c.transcript) detail.append(el("pre", c.transcript));
+    detail.hidden = false;
+    detail.scrollIntoView();
+  } catch (err) {
+    status.textContent = err.message;
+  }
+}
+
+document.getElementById("search").onsubmit = async e => {
+  e.preventDefault();
+  const q = e.target.q.value.trim();
+  if (!q) return;
+  try {
+    const results = await api("/search?n=50&q=" + encodeURIComponent(q));
+    status.textContent = results.length + " comics matching '" + q + "'";
+    showList(results.map(r => r.comic));
+  } catch (err) {
+    status.textContent = err.message;
+  }
+};
+
+window.onhashchange = () => { if (location.hash.length > 1) showComic(location.hash.slice(1)); };
+
+// Start with the newest comics
+(async () => {
+  const stats = await api("/stats");
+  const nums = [];
+  for (let n = stats.lastNum; n > 0 && nums.length < 24; n--) nums.push(n);
+  const comics = await Promise.all(nums.map(n => api("/comic/" + n).catch(() => null)));
+  status.textContent = stats.total + " comics indexed";
+  showList(comics.filter(c => c));
+  window.onhashchange();
+})();
+</script>
+</body>
+</html>
+`
+
+// apiError is the JSON body of a failed API request
+func apiError(format string, args ...any) map[string]string {
+	return map[string]string{"error": fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func printUsage() {
+	fmt.Println("XKCD Offline Tool")
+	fmt.Println("═════════════════")
 	fmt.Println("Usage:")
-	fmt.Println("  go run xkcd.go <command> [arguments]")
+	fmt.Println("  go run xkcd.go [global flags] <command> [arguments]")
 	fmt.Println("")
 	fmt.Println("Commands:")
-	fmt.Println("  update                    - Download and update the comic index")
-	fmt.Println("  search <keywords>         - Search comics by keywords")
-	fmt.Println("  show <number>            - Show specific comic by number")
-	fmt.Println("  random                   - Show a random comic")
-	fmt.Println("  stats                    - Show index statistics")
+	fmt.Println("  update [flags]            - Download and update the comic index")
+	fmt.Println("  backfill [flags]          - Fetch only the comics missing below the last indexed one")
+	fmt.Println("  watch [-interval D] [-image] [-on-new cmd]")
+	fmt.Println("                           - Check for new comics every D (default 30m) until")
+	fmt.Println("                             interrupted, adding and showing each new one")
+	fmt.Println("  images [-workers N] [-rate R]")
+	fmt.Println("                           - Download images of indexed comics into -images-dir")
+	fmt.Println("  search [flags] <keywords> - Search comics by keywords")
+	fmt.Println("  search -first [-open] <keywords>")
+	fmt.Println("                           - Show (or open) only the best match")
+	fmt.Println("  show [-highlight terms] [-online] [-image] [-format T] <numbers>")
+	fmt.Println("                           - Show comics by number, list (5,17) or range (100-110);")
+	fmt.Println("                             -online fetches and indexes comics not indexed yet,")
+	fmt.Println("                             honoring -rate and -retries;")
+	fmt.Println("                             -image draws the cached image in the terminal")
+	fmt.Println("  show [-online] latest     - Show the newest indexed comic (-online: fetch it first)")
+	fmt.Println("  next|prev [-image] [number]")
+	fmt.Println("                           - Show the indexed comic after or before a number, or")
+	fmt.Println("                             the comic viewed last (see history)")
+	fmt.Println("  list [-after D] [-before D]")
+	fmt.Println("                           - List comics, optionally within a date range")
+	fmt.Println("  random [-seed N]          - Show a random comic (a fixed seed repeats the pick)")
+	fmt.Println("  random [-query Q] [-year Y] [-after D] [-before D]")
+	fmt.Println("                           - Pick only among comics matching a query or date range")
+	fmt.Println("  open <number|random>     - Open a comic on xkcd.com in the default browser")
+	fmt.Println("  explain [-open] <number> - Show a comic with its explainxkcd.com link")
+	fmt.Println("  stats [-by year|terms|words]")
+	fmt.Println("                           - Show index statistics, or comics per year or the")
+	fmt.Println("                             most common title or transcript words")
+	fmt.Println("  stats -words [-n N] [-after D] [-before D] [-csv]")
+	fmt.Println("                           - Rank the N most common transcript words, optionally")
+	fmt.Println("                             of a date range, as a list or CSV")
+	fmt.Println("  tui                      - Browse and search comics in a full-screen terminal UI")
+	fmt.Println("  browse                   - Browse and search comics from a line-based prompt")
+	fmt.Println("  serve [-addr host:port]  - Serve a JSON API and web gallery (default localhost:8080)")
+	fmt.Println("  fav add|remove <number>  - Add a comic to or remove it from your favorites")
+	fmt.Println("  fav list                 - Show your favorite comics")
+	fmt.Println("  tag add <number> <tags>  - Tag a comic (tags are case-insensitive)")
+	fmt.Println("  tag remove <number> <tag>")
+	fmt.Println("                           - Remove a tag from a comic")
+	fmt.Println("  tag search <tag>         - List the comics with a tag")
+	fmt.Println("  tag list                 - List all tags and how often they are used")
+	fmt.Println("  export [-format F] [-query Q] [-n N] [-o path] [numbers]")
+	fmt.Println("                           - Export comics, search matches or the index (csv, ndjson,")
+	fmt.Println("                             md, html, or rss with the N newest)")
+	fmt.Println("  verify                   - Check the index for gaps and incomplete comics")
+	fmt.Println("  verify-index             - Check the index against its stored checksum")
+	fmt.Println("  restore                  - Swap the index with the backup of its previous save")
+	fmt.Println("  merge <file>             - Add the comics of another index file to this one")
+	fmt.Println("  import <dir>             - Add the comics of a directory of info.0.json files,")
+	fmt.Println("                             e.g. an archive of xkcd.com's JSON, without going online")
+	fmt.Println("  diff <old> [new]         - List comics added, removed or edited between two index")
+	fmt.Println("                             files (default new: the current index)")
+	fmt.Println("  prune [-keep N-M] [-before D] [-after D] [-dry-run]")
+	fmt.Println("                           - Remove comics outside a number or date range")
+	fmt.Println("  audit                    - Show the log of changes made to the index")
+	fmt.Println("  history [clear]          - List the last 100 comics viewed with show, random and")
+	fmt.Println("                             open, newest first, or forget them")
+	fmt.Println("  use [name]               - Switch to a named collection, or list the collections")
+	fmt.Println("                             (use -default goes back to the default index)")
+	fmt.Println("  help                     - Show this help; <command> -h describes a command's flags")
+	fmt.Println("")
+	fmt.Println("Global flags:")
+	fmt.Println("  (Defaults for any flag can be set in ~/.config/xkcd/config.toml or $XKCD_CONFIG)")
+	fmt.Println("  -index path              - Index file to use (default $XKCD_INDEX, ./xkcd_index.json")
+	fmt.Println("                             if present, else ~/.xkcd/index.json or $XDG_DATA_HOME)")
+	fmt.Println("  -db path                 - Keep the index in a SQLite database instead (needs a")
+	fmt.Println("                             build with -tags sqlite; see README)")
+	fmt.Println("  -collection name         - Use the index of a named collection for this command")
+	fmt.Println("  -compress                - Save the index gzip-compressed as <index>.gz")
+	fmt.Println("  -images-dir path         - Directory of the cached images (default images)")
+	fmt.Println("  -timeout D               - Time limit for each request (default 10s)")
+	fmt.Println("  -user-agent UA           - User-Agent sent to xkcd.com (default xkcd-cli/1.0)")
+	fmt.Println("  -proxy URL               - Send requests through this proxy: http://, https:// or")
+	fmt.Println("                             socks5://host:port (default $HTTPS_PROXY/$HTTP_PROXY)")
+	fmt.Println("  -json                    - Print show, search, random and stats output as JSON")
+	fmt.Println("  -no-pager                - Don't page show, search and stats output through")
+	fmt.Println("                             $PAGER (default less, then more) on a terminal")
+	fmt.Println("  -pager                   - Page output even when it fits on one screen")
+	fmt.Println("  -width N                 - Wrap comic text at N columns (default: fit the terminal,")
+	fmt.Println("                             else 60)")
+	fmt.Println("  -plain                   - Show comics without the box drawing (default when the")
+	fmt.Println("                             output isn't a terminal; -plain=false keeps the box)")
+	fmt.Println("  -v                       - Print more detail about what a command is doing")
+	fmt.Println("  -q                       - Only print warnings and errors besides the output;")
+	fmt.Println("                             status and progress messages go to stderr")
+	fmt.Println("  -color                   - Force colored output and term highlighting")
+	fmt.Println("  -no-color                - Disable colored output (also honors NO_COLOR,")
+	fmt.Println("                             CLICOLOR=0 and CLICOLOR_FORCE)")
+	fmt.Println("")
+	fmt.Println("Update and backfill flags:")
+	fmt.Println("  -workers N               - Download N comics (or images) concurrently (default 8)")
+	fmt.Println("  -rate R                  - Send at most R requests per second (default 10)")
+	fmt.Println("  -retries N               - Retry network/server errors N times (default 3)")
+	fmt.Println("  -images                  - Also download comic images into -images-dir (update only)")
+	fmt.Println("  -check-interval D        - Don't look for new comics again within D (default 1h,")
+	fmt.Println("                             0 = always; update only)")
+	fmt.Println("  -force                   - Look for new comics even within -check-interval")
+	fmt.Println("  -refresh-last N          - Fetch the newest N comics again, overwriting edits")
+	fmt.Println("  -dry-run                 - Only print which comics update would fetch")
+	fmt.Println("  -max N                   - Fetch at most N new comics, leaving the rest for")
+	fmt.Println("                             the next update")
+	fmt.Println("  -fetch-transcripts       - Look up missing transcripts on explainxkcd.com (update")
+	fmt.Println("                             only)")
+	fmt.Println("  -on-new cmd              - Run a shell command for each new comic, with its number")
+	fmt.Println("                             and title as arguments (update and watch)")
+	fmt.Println("  -progress bar|verbose|summary")
+	fmt.Println("                           - Progress display (default: a bar on a terminal, else a")
+	fmt.Println("                             summary line every 10%; also for backfill and images)")
+	fmt.Println("")
+	fmt.Println("Search syntax:")
+	fmt.Println("  a b                      - Comics matching a or b")
+	fmt.Println("  a AND b, a OR b, NOT a   - Boolean operators (AND binds tighter than OR)")
+	fmt.Println("  -a                       - Exclude comics matching a")
+	fmt.Println("  \"a b\"                    - Match the exact phrase")
+	fmt.Println("  title:a, alt:a, transcript:a")
+	fmt.Println("                           - Only match a in that field")
+	fmt.Println("")
+	fmt.Println("Search flags:")
+	fmt.Println("  -regex                   - Treat the query as a regular expression")
+	fmt.Println("  -whole-word              - Only match complete words (\"go\" skips \"google\")")
+	fmt.Println("  -case-sensitive          - Match case exactly (\"IT\" doesn't match \"it\")")
+	fmt.Println("  -stopwords               - Keep common words like \"the\" in the query (dropped")
+	fmt.Println("                             by default unless quoted)")
+	fmt.Println("  -n, -limit N             - Print N results (default 10 when piped, 0 = all)")
+	fmt.Println("  -page-size N             - Results per page on a terminal (default: fit the")
+	fmt.Println("                             terminal height, -1 = no paging)")
+	fmt.Println("  -after D, -before D      - Only comics published in this date range")
+	fmt.Println("                             (inclusive; YYYY-MM-DD, YYYY/MM/DD, YYYY-MM or YYYY)")
+	fmt.Println("  -sort score|date|num     - Order results by relevance (default; ties newest first),")
+	fmt.Println("                             publication date (newest first) or comic number")
+	fmt.Println("  -normalize               - Show relevance as 0-100% of the top result")
+	fmt.Println("  -group-dedupe            - Collapse results with near-duplicate titles")
+	fmt.Println("  -expand                  - With -group-dedupe, list the collapsed results")
+	fmt.Println("  -min-score N             - Drop results scoring below N")
+	fmt.Println("  -count                   - Only print the number of matching comics")
+	fmt.Println("  -o path                  - Write the results to a file (also for show and random)")
+	fmt.Println("  -format T                - Print each result with a Go text/template such as")
+	fmt.Println("                             '{{.Num}}: {{.Title}}', plus .Score (also for show)")
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  go run xkcd.go update")
@@ -446,77 +6660,849 @@ func printUsage() {
 	fmt.Println("  go run xkcd.go show 353")
 	fmt.Println("  go run xkcd.go random")
 	fmt.Println("  go run xkcd.go stats")
+	fmt.Println("  go run xkcd.go serve -addr :8080")
+}
+
+
+
+// outputFile is set when -o sends a command's output to a file, which then
+// gets the same plain, uncolored output as a redirected stdout
+var outputFile bool
+
+// openOutput returns where show, search and random write: the file at
+// path, or else stdout, paged as startPager decides
+func openOutput(path string) (out io.Writer, closeOutput func(), err error) {
+	if path == "" {
+		stop := startPager()
+		return os.Stdout, stop, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	outputFile = true
+	return f, func() { f.Close() }, nil
+}
+
+// config holds flag defaults from the config file, by command name and
+// then flag name. Global flags are in the "" section.
+type config map[string]map[string]string
+
+// settings is the config file loaded by main
+var settings config
+
+// configPath is $XKCD_CONFIG, or config.toml in the user's config
+// directory (~/.config/xkcd on Linux)
+func configPath() string {
+	if env := os.Getenv("XKCD_CONFIG"); env != "" {
+		return env
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "xkcd", "config.toml")
+}
+
+// loadConfig reads the config file at path. A missing file is an empty
+// config rather than an error.
+func loadConfig(path string) (config, error) {
+	f, err := os.Open(path)
+	if path == "" || errors.Is(err, fs.ErrNotExist) {
+		return config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig reads the subset of TOML the config needs: "key = value"
+// lines, with [command] tables for the flags of one command. Values are
+// strings, numbers or booleans, and "~/" at the start of a string stands
+// for the home directory.
+//
+//	index = "~/comics/xkcd.json"
+//	no-color = true
+//
+//	[search]
+//	n = 20
+func parseConfig(r io.Reader) (config, error) {
+	cfg := config{"": {}}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			name, ok := strings.CutSuffix(line, "]")
+			if !ok {
+				return nil, fmt.Errorf("line %d: unterminated table name", lineNum)
+			}
+			section = strings.TrimSpace(name[1:])
+			if cfg[section] == nil {
+				cfg[section] = make(map[string]string)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNum)
+		}
+		key = strings.TrimSpace(key)
+		value, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		cfg[section][key] = value
+	}
+	return cfg, scanner.Err()
+}
+
+// parseConfigValue unquotes a string value, or strips a trailing comment
+// from a bare one
+func parseConfigValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		value, _, _ = strings.Cut(value, "#")
+		return strings.TrimSpace(value), nil
+	}
+	end := 1
+	for end < len(value) && value[end] != '"' {
+		if value[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(value) {
+		return "", fmt.Errorf("unterminated string %s", value)
+	}
+	if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after string", rest)
+	}
+	str, err := strconv.Unquote(value[:end+1])
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", value[:end+1])
+	}
+	if rest, ok := strings.CutPrefix(str, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			str = filepath.Join(home, rest)
+		}
+	}
+	return str, nil
+}
+
+// applyConfig sets the flags of fs named in the given config section, so
+// they become defaults that the command line then overrides
+func applyConfig(fs *flag.FlagSet, section string) error {
+	for name, value := range settings[section] {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config %s: unknown flag %q for %s", configPath(), name, valueOr(section, "global flags"))
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config %s: %s: %v", configPath(), name, err)
+		}
+	}
+	return nil
+}
+
+// commandFlags is a subcommand's flag set; Parse applies the command's
+// config section before the arguments
+type commandFlags struct {
+	*flag.FlagSet
 }
 
+func (c commandFlags) Parse(args []string) error {
+	if err := applyConfig(c.FlagSet, c.Name()); err != nil {
+		log.Fatal(err)
+	}
+	return c.FlagSet.Parse(args)
+}
 
+// newFlagSet creates the flag set of a subcommand. Its -h prints how to
+// call the command, what it does and its flags.
+func newFlagSet(name, args, summary string) commandFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: go run xkcd.go [global flags] %s\n\n%s\n", strings.TrimSpace(name+" "+args), summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(out, "\nFlags:")
+			fs.PrintDefaults()
+		}
+		fmt.Fprintln(out, "\nRun 'go run xkcd.go -h' for the global flags and other commands.")
+	}
+	return commandFlags{fs}
+}
 
 func main() {
-	if len(os.Args) < 2 {
+	flag.Usage = printUsage
+
+	// The config file provides defaults, so it is applied before the
+	// command line is parsed
+	var err error
+	if settings, err = loadConfig(configPath()); err != nil {
+		log.Fatal(err)
+	}
+	if err := applyConfig(flag.CommandLine, ""); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		plainSet = plainSet || f.Name == "plain"
+	})
+	switch {
+	case *verboseFlag && *quietFlag:
+		log.Fatal("-v and -q can't be combined")
+	case *verboseFlag:
+		verbosity = levelVerbose
+	case *quietFlag:
+		verbosity = levelQuiet
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
+	command := args[0]
+
+	// Ctrl-C or SIGTERM cancels ctx, letting long downloads save their
+	// progress and stop instead of dying mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A custom client for more control over aspects like timeouts,
+	// proxies, and connection pooling
+	client, err := newClient(*timeoutFlag, *proxyFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	indexPath, err := resolveIndexPath(*indexFlag, *collectionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var store Store = &jsonStore{path: indexPath, compress: *compressFlag}
+	if *dbFlag != "" {
+		if openDB == nil {
+			log.Fatal("-db needs SQLite support; rebuild with: go build -tags sqlite")
+		}
+		if store, err = openDB(*dbFlag); err != nil {
+			log.Fatalf("Opening %s failed: %v", *dbFlag, err)
+		}
+	}
+	loadUserData(store)
 
 	switch command {
 	case "update":
-		if err := updateIndex(); err != nil {
+		updateFlags := newFlagSet("update", "[flags]", "Download the comics published since the last update into the index.")
+		workers := updateFlags.Int("workers", 8, "number of comics to download concurrently")
+		rate := updateFlags.Float64("rate", 10, "maximum requests per second to xkcd.com (0 = unlimited)")
+		retries := updateFlags.Int("retries", 3, "times to retry a comic after a network or server error")
+		images := updateFlags.Bool("images", false, "also download the images of all indexed comics")
+		checkInterval := updateFlags.Duration("check-interval", time.Hour, "skip checking for new comics if the last check was more recent (0 = always check)")
+		force := updateFlags.Bool("force", false, "check for new comics even within -check-interval")
+		refreshLast := updateFlags.Int("refresh-last", 0, "fetch the newest N comics again, to pick up later edits")
+		dryRun := updateFlags.Bool("dry-run", false, "only print which comics would be fetched")
+		maxNew := updateFlags.Int("max", 0, "fetch at most N new comics this run (0 = all)")
+		transcripts := updateFlags.Bool("fetch-transcripts", false, "look up the transcripts xkcd.com lacks on explainxkcd.com")
+		onNew := updateFlags.String("on-new", "", "shell command run for each new comic, with its number and title as arguments")
+		progress := progressMode("auto")
+		updateFlags.Var(&progress, "progress", "how to show progress (`mode`: auto, bar, verbose or summary)")
+		updateFlags.Parse(args[1:])
+
+		f := newFetcher(client, *agentFlag, *rate, *retries)
+		opts := updateOptions{
+			workers:       *workers,
+			checkInterval: *checkInterval,
+			force:         *force,
+			refreshLast:   *refreshLast,
+			progress:      progress,
+			dryRun:        *dryRun,
+			maxNew:        *maxNew,
+			transcripts:   *transcripts,
+			onNew:         *onNew,
+		}
+		if _, err := updateIndex(ctx, store, f, opts); err != nil {
 			log.Fatalf("Update failed: %v", err)
 		}
+		if *images && ctx.Err() == nil {
+			if err := downloadImages(ctx, store, f, *workers, progress); err != nil {
+				log.Fatalf("Image download failed: %v", err)
+			}
+		}
+
+	case "watch":
+		watchFlags := newFlagSet("watch", "[flags]", "Check for new comics periodically, adding and showing each one.")
+		interval := watchFlags.Duration("interval", 30*time.Minute, "time between checks")
+		rate := watchFlags.Float64("rate", 10, "maximum requests per second to xkcd.com (0 = unlimited)")
+		retries := watchFlags.Int("retries", 3, "times to retry a comic after a network or server error")
+		renderImg := watchFlags.Bool("image", false, "download the images of new comics and render them in the terminal")
+		onNew := watchFlags.String("on-new", "", "shell command run for each new comic, with its number and title as arguments")
+		watchFlags.Parse(args[1:])
+
+		if *interval <= 0 {
+			log.Fatal("Watch failed: -interval must be positive")
+		}
+		f := newFetcher(client, *agentFlag, *rate, *retries)
+		opts := updateOptions{workers: 1, progress: "summary", onNew: *onNew}
+		show := showOptions{image: *renderImg, out: os.Stdout}
+		if err := watch(ctx, store, f, opts, *interval, show); err != nil {
+			log.Fatalf("Watch failed: %v", err)
+		}
+
+	case "backfill":
+		backfillFlags := newFlagSet("backfill", "[flags]", "Fetch only the comics missing below the last indexed one.")
+		workers := backfillFlags.Int("workers", 8, "number of comics to download concurrently")
+		rate := backfillFlags.Float64("rate", 10, "maximum requests per second to xkcd.com (0 = unlimited)")
+		retries := backfillFlags.Int("retries", 3, "times to retry a comic after a network or server error")
+		progress := progressMode("auto")
+		backfillFlags.Var(&progress, "progress", "how to show progress (`mode`: auto, bar, verbose or summary)")
+		backfillFlags.Parse(args[1:])
+
+		opts := updateOptions{workers: *workers, progress: progress}
+		if err := backfill(ctx, store, newFetcher(client, *agentFlag, *rate, *retries), opts); err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+
+	case "prune":
+		pruneFlags := newFlagSet("prune", "[flags]", "Remove comics outside a number or date range.")
+		keep := pruneFlags.String("keep", "", "only keep this range of comic numbers (e.g. 2000-, -500, 100-200)")
+		before := pruneFlags.String("before", "", "remove comics published before this date")
+		after := pruneFlags.String("after", "", "remove comics published after this date")
+		dryRun := pruneFlags.Bool("dry-run", false, "report what would be removed without saving")
+		pruneFlags.Parse(args[1:])
+
+		var filter pruneFilter
+		var err error
+		if *keep != "" {
+			if filter.from, filter.to, err = parseKeepRange(*keep); err != nil {
+				log.Fatalf("Prune failed: %v", err)
+			}
+		}
+		// The flags name what is removed, so the kept range runs from
+		// -before to -after
+		if filter.dates, err = newDateRange(*before, *after); err != nil {
+			log.Fatalf("Prune failed: %v", err)
+		}
+		if err := pruneIndex(store, filter, *dryRun); err != nil {
+			log.Fatalf("Prune failed: %v", err)
+		}
+
+	case "diff":
+		diffFlags := newFlagSet("diff", "<old index> [new index]", "List the comics added, removed or edited between two indexes (default new: the current index).")
+		diffFlags.Parse(args[1:])
+
+		if diffFlags.NArg() < 1 || diffFlags.NArg() > 2 {
+			log.Fatal("Usage: diff <old index> [new index]")
+		}
+		if err := diffIndexFiles(os.Stdout, store, diffFlags.Arg(0), diffFlags.Arg(1)); err != nil {
+			log.Fatalf("Diff failed: %v", err)
+		}
+
+	case "merge":
+		mergeFlags := newFlagSet("merge", "<other index file>", "Add the comics of another index file to this one.")
+		mergeFlags.Parse(args[1:])
+
+		if mergeFlags.NArg() < 1 {
+			log.Fatal("Usage: merge <other index file>")
+		}
+		if err := mergeIndex(store, mergeFlags.Arg(0)); err != nil {
+			log.Fatalf("Merge failed: %v", err)
+		}
+
+	case "import":
+		importFlags := newFlagSet("import", "<directory>", "Add the comics of a directory of info.0.json files, without going online.")
+		importFlags.Parse(args[1:])
+
+		if importFlags.NArg() < 1 {
+			log.Fatal("Usage: import <directory>")
+		}
+		if err := importArchive(store, importFlags.Arg(0)); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+
+	case "images":
+		imagesFlags := newFlagSet("images", "[flags]", "Download the images of indexed comics into -images-dir.")
+		workers := imagesFlags.Int("workers", 8, "number of images to download concurrently")
+		rate := imagesFlags.Float64("rate", 10, "maximum requests per second (0 = unlimited)")
+		retries := imagesFlags.Int("retries", 3, "times to retry an image after a network or server error")
+		progress := progressMode("auto")
+		imagesFlags.Var(&progress, "progress", "how to show progress (`mode`: auto, bar, verbose or summary)")
+		imagesFlags.Parse(args[1:])
+
+		if err := downloadImages(ctx, store, newFetcher(client, *agentFlag, *rate, *retries), *workers, progress); err != nil {
+			log.Fatalf("Image download failed: %v", err)
+		}
 
 	case "search":
-		if len(os.Args) < 3 {
+		searchFlags := newFlagSet("search", "[flags] <query>", "Search comics by keywords, phrases, field: terms and AND/OR/NOT.")
+		normalize := searchFlags.Bool("normalize", false, "show scores as 0-100 relevance relative to the top result")
+		groupDedupe := searchFlags.Bool("group-dedupe", false, "collapse results with near-duplicate titles into their best match")
+		expand := searchFlags.Bool("expand", false, "with -group-dedupe, also list the collapsed results")
+		sortBy := searchFlags.String("sort", "score", "order results by score, date (newest first) or num")
+		regex := searchFlags.Bool("regex", false, "treat the query as a regular expression")
+		wholeWord := searchFlags.Bool("whole-word", false, "only match complete words (\"go\" doesn't match \"google\")")
+		keepStopwords := searchFlags.Bool("stopwords", false, "keep common words like \"the\" and \"of\" in the query")
+		caseSensitive := searchFlags.Bool("case-sensitive", false, "match upper and lower case exactly (\"IT\" doesn't match \"it\")")
+		var limit int
+		searchFlags.IntVar(&limit, "n", 10, "number of results to print (0 = all)")
+		searchFlags.IntVar(&limit, "limit", 10, "same as -n")
+		pageSize := searchFlags.Int("page-size", 0, "results per page on a terminal (0 = fit the terminal height, -1 = no paging)")
+		after := searchFlags.String("after", "", "only comics published on or after this date")
+		before := searchFlags.String("before", "", "only comics published on or before this date")
+		count := searchFlags.Bool("count", false, "only print the number of matching comics")
+		minScore := searchFlags.Int("min-score", 0, "drop results scoring below this")
+		var lucky bool
+		searchFlags.BoolVar(&lucky, "first", false, "show only the best match in full instead of listing results")
+		searchFlags.BoolVar(&lucky, "lucky", false, "same as -first")
+		openBest := searchFlags.Bool("open", false, "with -first, open the best match on xkcd.com instead")
+		output := searchFlags.String("o", "", "write the results to this file instead of stdout")
+		format := searchFlags.String("format", "", "print each result with this Go text/template (comic fields plus .Score and .Snippet)")
+		searchFlags.Parse(args[1:])
+
+		if searchFlags.NArg() == 0 {
 			log.Fatal("Search query is required")
 		}
-		query := strings.Join(os.Args[2:], " ")
-		
-		results, err := search(query)
+		if limit < 0 {
+			log.Fatal("Search failed: -n must be 0 (all) or more")
+		}
+		limitSet := false
+		searchFlags.Visit(func(f *flag.Flag) {
+			limitSet = limitSet || f.Name == "n" || f.Name == "limit"
+		})
+		query := strings.Join(searchFlags.Args(), " ")
+		if !slices.Contains(sortOrders, *sortBy) {
+			log.Fatalf("Search failed: unknown sort order %q (use %s)", *sortBy, strings.Join(sortOrders, ", "))
+		}
+		if *openBest && !lucky {
+			log.Fatal("Search failed: -open requires -first")
+		}
+
+		dates, err := newDateRange(*after, *before)
+		if err != nil {
+			log.Fatalf("Search failed: %v", err)
+		}
+		var tmpl *texttemplate.Template
+		if *format != "" {
+			if tmpl, err = parseFormat(*format); err != nil {
+				log.Fatalf("Search failed: %v", err)
+			}
+		}
+
+		opts := searchOptions{regex: *regex, wholeWord: *wholeWord, dates: dates, stopwords: *keepStopwords, caseSensitive: *caseSensitive, minScore: *minScore}
+		results, err := search(store, query, opts)
+		if err != nil {
+			log.Fatalf("Search failed: %v", err)
+		}
+
+		out, closeOutput, err := openOutput(*output)
 		if err != nil {
 			log.Fatalf("Search failed: %v", err)
 		}
+		defer closeOutput()
 
-		if len(results) == 0 {
-			fmt.Printf("No comics found matching '%s'\n", query)
+		if *count {
+			if *jsonFlag {
+				err = printJSON(out, map[string]int{"count": len(results)})
+			} else {
+				_, err = fmt.Fprintln(out, len(results))
+			}
+			if err != nil {
+				fatalf("Search failed: %v", err)
+			}
+			return
+		}
+
+		// Results come ranked by score, so the first one is the best match
+		if lucky {
+			if len(results) == 0 {
+				fatalf("Search failed: no comics found matching '%s'", query)
+			}
+			best := results[0].Comic
+			switch {
+			case *openBest:
+				openURL(comicURL(best.Num))
+			case *jsonFlag:
+				err = printJSON(out, best)
+			case tmpl != nil:
+				err = printFormatted(out, tmpl, best)
+			default:
+				displayComic(out, best, newHighlighter(query, opts))
+			}
+			if err != nil {
+				fatalf("Search failed: %v", err)
+			}
 			return
 		}
 
-		fmt.Printf("Found %d comics matching '%s':\n\n", len(results), query)
-		
-		maxResults := 10
-		if len(results) < maxResults {
+		total := len(results)
+		if *groupDedupe {
+			results = groupSimilar(results)
+		}
+		sortResults(results, *sortBy)
+
+		// On a terminal, results are paged instead of cut off at 10, unless
+		// a limit was asked for. A pager does its own paging.
+		paginate := *pageSize >= 0 && !*jsonFlag && !outputFile && isTerminal(os.Stdout) && isTerminal(os.Stdin)
+		if (paginate || pagerActive) && !limitSet {
+			limit = 0
+		}
+		perPage := *pageSize
+		if perPage == 0 {
+			perPage = max(1, (terminalRows()-1)/searchResultLines)
+		}
+
+		maxResults := limit
+		if maxResults <= 0 || len(results) < maxResults {
 			maxResults = len(results)
 		}
 
+		hl := newHighlighter(query, opts)
+		for _, result := range results[:maxResults] {
+			result.Snippet = hl.snippet(result.Comic.Transcript)
+		}
+
+		if *jsonFlag {
+			// Always an array, even when nothing matched
+			shown := append([]*SearchResult{}, results[:maxResults]...)
+			if err := printJSON(out, shown); err != nil {
+				fatalf("Search failed: %v", err)
+			}
+			return
+		}
+
+		// A template prints just the results, for scripts
+		if tmpl != nil {
+			for _, result := range results[:maxResults] {
+				data := struct {
+					*Comic
+					Score   int
+					Snippet string
+				}{result.Comic, result.Score, result.Snippet}
+				if err := printFormatted(out, tmpl, data); err != nil {
+					fatalf("Search failed: %v", err)
+				}
+			}
+			return
+		}
+
+		if total == 0 {
+			fmt.Fprintf(out, "No comics found matching '%s'\n", query)
+			return
+		}
+
+		fmt.Fprintf(out, "Found %d comics matching '%s':\n\n", total, query)
+
+		topScore := 0
+		for _, result := range results {
+			topScore = max(topScore, result.Score)
+		}
+		stdin := bufio.NewReader(os.Stdin)
+
 		for i := 0; i < maxResults; i++ {
+			if paginate && i > 0 && i%perPage == 0 && !morePrompt(stdin, maxResults-i) {
+				return
+			}
 			result := results[i]
-			fmt.Printf("%d. #%d: %s (score: %d)\n", 
-				i+1, result.Comic.Num, result.Comic.Title, result.Score)
-			fmt.Printf("   URL: %s/%d/\n", baseURL, result.Comic.Num)
-			fmt.Printf("   %s\n\n", result.Comic.Alt)
+			scoreText := fmt.Sprintf("score: %d", result.Score)
+			if *normalize {
+				scoreText = fmt.Sprintf("relevance: %d%%", normalizeScore(result.Score, topScore))
+			}
+			printSearchResult(out, i+1, result, scoreText, hl, *expand)
 		}
 
 		if len(results) > maxResults {
-			fmt.Printf("... and %d more results\n", len(results)-maxResults)
+			fmt.Fprintf(out, "... and %d more results\n", len(results)-maxResults)
+		}
+
+	case "list":
+		listFlags := newFlagSet("list", "[flags]", "List comics, optionally within a date range.")
+		after := listFlags.String("after", "", "only comics published on or after this date")
+		before := listFlags.String("before", "", "only comics published on or before this date")
+		listFlags.Parse(args[1:])
+
+		dates, err := newDateRange(*after, *before)
+		if err != nil {
+			log.Fatalf("List failed: %v", err)
+		}
+		if err := listComics(os.Stdout, store, dates); err != nil {
+			log.Fatalf("List failed: %v", err)
 		}
 
 	case "show":
-		if len(os.Args) < 3 {
+		showFlags := newFlagSet("show", "[flags] <numbers|latest>", "Show comics by number, list (5,17) or range (100-110), or the newest one.")
+		highlight := showFlags.String("highlight", "", "search terms to highlight in the comic")
+		var online bool
+		showFlags.BoolVar(&online, "online", false, "fetch comics missing from the index (or with 'latest', the current comic) from xkcd.com and index them")
+		showFlags.BoolVar(&online, "fetch", false, "same as -online")
+		rate := showFlags.Float64("rate", 10, "maximum requests per second to xkcd.com with -online (0 = unlimited)")
+		retries := showFlags.Int("retries", 3, "times to retry a comic after a network or server error")
+		renderImg := showFlags.Bool("image", false, "render the cached comic image in the terminal")
+		output := showFlags.String("o", "", "write the comics to this file instead of stdout")
+		format := showFlags.String("format", "", "print each comic with this Go text/template, e.g. '{{.Num}}: {{.Title}}'")
+		showFlags.Parse(args[1:])
+
+		if showFlags.NArg() < 1 {
 			log.Fatal("Comic number is required")
 		}
-		if err := showComic(os.Args[2]); err != nil {
+		var hl *highlighter
+		if *highlight != "" {
+			hl = newHighlighter(*highlight, searchOptions{})
+		}
+		out, closeOutput, err := openOutput(*output)
+		if err != nil {
+			log.Fatalf("Show failed: %v", err)
+		}
+		defer closeOutput()
+
+		opts := showOptions{hl: hl, image: *renderImg, out: out}
+		if *format != "" {
+			if opts.format, err = parseFormat(*format); err != nil {
+				fatalf("Show failed: %v", err)
+			}
+		}
+		if online {
+			opts.fetcher = newFetcher(client, *agentFlag, *rate, *retries)
+		}
+		if showFlags.Arg(0) == "latest" {
+			if err := showLatest(ctx, store, opts); err != nil {
+				fatalf("Show failed: %v", err)
+			}
+			return
+		}
+		if err := showComics(ctx, store, showFlags.Arg(0), opts); err != nil {
+			fatalf("Show failed: %v", err)
+		}
+
+	case "next", "prev":
+		adjacentFlags := newFlagSet(command, "[flags] [number]", "Show the indexed comic after (next) or before (prev) a number, or the comic viewed last.")
+		renderImg := adjacentFlags.Bool("image", false, "render the cached comic image in the terminal")
+		adjacentFlags.Parse(args[1:])
+
+		step := 1
+		if command == "prev" {
+			step = -1
+		}
+		opts := showOptions{image: *renderImg, out: os.Stdout}
+		if err := showAdjacent(store, adjacentFlags.Arg(0), step, opts); err != nil {
 			log.Fatalf("Show failed: %v", err)
 		}
 
 	case "random":
-		if err := showRandom(); err != nil {
+		randomFlags := newFlagSet("random", "[flags]", "Show a random comic.")
+		seed := randomFlags.Int64("seed", 0, "seed for a reproducible pick (0 = random)")
+		query := randomFlags.String("query", "", "only pick among comics matching this search query")
+		year := randomFlags.String("year", "", "only pick among comics published in this year")
+		after := randomFlags.String("after", "", "only pick among comics published on or after this date")
+		before := randomFlags.String("before", "", "only pick among comics published on or before this date")
+		output := randomFlags.String("o", "", "write the comic to this file instead of stdout")
+		randomFlags.Parse(args[1:])
+
+		if *year != "" {
+			if *after != "" || *before != "" {
+				log.Fatal("Random failed: -year can't be combined with -after or -before")
+			}
+			*after, *before = *year, *year
+		}
+		dates, err := newDateRange(*after, *before)
+		if err != nil {
+			log.Fatalf("Random failed: %v", err)
+		}
+		out, closeOutput, err := openOutput(*output)
+		if err != nil {
 			log.Fatalf("Random failed: %v", err)
 		}
+		defer closeOutput()
+
+		if err := showRandom(out, store, newRand(*seed), randomFilter{query: *query, dates: dates}); err != nil {
+			fatalf("Random failed: %v", err)
+		}
+
+	case "open":
+		openFlags := newFlagSet("open", "<number|random>", "Open a comic on xkcd.com in the default browser.")
+		openFlags.Parse(args[1:])
+
+		if openFlags.NArg() < 1 {
+			log.Fatal("Comic number or 'random' is required")
+		}
+		if err := openComic(store, openFlags.Arg(0), newRand(0)); err != nil {
+			log.Fatalf("Open failed: %v", err)
+		}
+
+	case "fav":
+		favFlags := newFlagSet("fav", "add|remove <number> | list", "Manage your favorite comics.")
+		favFlags.Parse(args[1:])
+
+		if favFlags.Arg(0) == "list" {
+			defer startPager()()
+		}
+		if err := manageFavorites(store, favFlags.Args()); err != nil {
+			fatalf("Fav failed: %v", err)
+		}
+
+	case "tag":
+		tagFlags := newFlagSet("tag", "add <number> <tags> | remove <number> <tag> | search <tag> | list", "Label comics with your own tags.")
+		tagFlags.Parse(args[1:])
+
+		if err := manageTags(store, tagFlags.Args()); err != nil {
+			log.Fatalf("Tag failed: %v", err)
+		}
+
+	case "explain":
+		explainFlags := newFlagSet("explain", "[flags] <number>", "Show a comic with its explainxkcd.com link.")
+		open := explainFlags.Bool("open", false, "open the explanation in the browser")
+		explainFlags.Parse(args[1:])
+
+		if explainFlags.NArg() < 1 {
+			log.Fatal("Comic number is required")
+		}
+		if err := explainComic(store, explainFlags.Arg(0), *open); err != nil {
+			log.Fatalf("Explain failed: %v", err)
+		}
+
+	case "tui":
+		newFlagSet("tui", "", "Browse and search comics in a full-screen terminal UI.").Parse(args[1:])
+
+		if err := runTUI(store); err != nil {
+			log.Fatalf("TUI failed: %v", err)
+		}
+
+	case "browse":
+		newFlagSet("browse", "", "Browse and search comics from a line-based prompt.").Parse(args[1:])
+
+		if err := browse(store, os.Stdin); err != nil {
+			log.Fatalf("Browse failed: %v", err)
+		}
 
 	case "stats":
-		if err := showStats(); err != nil {
+		statsFlags := newFlagSet("stats", "[flags]", "Show index statistics.")
+		by := statsFlags.String("by", "", "break the index down by year, terms (title words) or words (transcript words)")
+		wordsOnly := statsFlags.Bool("words", false, "same as -by words")
+		n := statsFlags.Int("n", topTermsCount, "with -by terms or words, how many words to list (0 = all)")
+		after := statsFlags.String("after", "", "with -by terms or words, only count comics published on or after this date")
+		before := statsFlags.String("before", "", "with -by terms or words, only count comics published on or before this date")
+		asCSV := statsFlags.Bool("csv", false, "with -by terms or words, print word,count CSV")
+		statsFlags.Parse(args[1:])
+		if *wordsOnly {
+			*by = "words"
+		}
+		if *by != "" && !slices.Contains(statsBreakdowns, *by) {
+			log.Fatalf("Stats failed: unknown breakdown %q (use %s)", *by, strings.Join(statsBreakdowns, ", "))
+		}
+		dates, err := newDateRange(*after, *before)
+		if err != nil {
 			log.Fatalf("Stats failed: %v", err)
 		}
 
+		if !*asCSV {
+			defer startPager()()
+		}
+		opts := statsOptions{by: *by, n: *n, dates: dates, csv: *asCSV}
+		if err := showStats(os.Stdout, store, opts); err != nil {
+			fatalf("Stats failed: %v", err)
+		}
+
+	case "serve":
+		serveFlags := newFlagSet("serve", "[flags]", "Serve a read-only JSON API and web gallery over the index.")
+		addr := serveFlags.String("addr", "localhost:8080", "address to listen on")
+		serveFlags.Parse(args[1:])
+
+		if err := serve(ctx, store, *addr); err != nil {
+			log.Fatalf("Serve failed: %v", err)
+		}
+
+	case "export":
+		exportFlags := newFlagSet("export", "[flags] [numbers]", "Export comics, search matches or the whole index.")
+		format := exportFlags.String("format", "csv", "output format: csv, ndjson, md, html or rss")
+		query := exportFlags.String("query", "", "only export comics matching this search query")
+		output := exportFlags.String("o", "", "write to this file instead of stdout")
+		limit := exportFlags.Int("n", 0, "export at most this many comics (0 = all; rss takes the newest)")
+		exportFlags.Parse(args[1:])
+
+		opts := exportOptions{
+			format:  *format,
+			query:   *query,
+			spec:    exportFlags.Arg(0),
+			outPath: *output,
+			limit:   *limit,
+		}
+		if err := exportComics(store, opts); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+
+	case "history":
+		historyFlags := newFlagSet("history", "[clear]", "List the comics viewed with show, random and open, newest first.")
+		historyFlags.Parse(args[1:])
+
+		if err := manageHistory(os.Stdout, store, historyFlags.Args()); err != nil {
+			log.Fatalf("History failed: %v", err)
+		}
+
+	case "audit":
+		newFlagSet("audit", "", "Show the log of changes made to the index.").Parse(args[1:])
+
+		if err := showAudit(os.Stdout, store); err != nil {
+			log.Fatalf("Audit failed: %v", err)
+		}
+
+	case "verify":
+		newFlagSet("verify", "", "Check the index for gaps and incomplete comics.").Parse(args[1:])
+
+		if err := verifyIndex(os.Stdout, store); err != nil {
+			log.Fatalf("Verify failed: %v", err)
+		}
+
+	case "restore":
+		newFlagSet("restore", "", "Swap the index with the backup of its previous save.").Parse(args[1:])
+
+		if err := restoreBackup(store); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+
+	case "verify-index":
+		newFlagSet("verify-index", "", "Check the index against its stored checksum.").Parse(args[1:])
+
+		files, ok := store.(*jsonStore)
+		if !ok {
+			log.Fatal("verify-index checks a JSON index; a -db database has no checksum file")
+		}
+		if err := verifyIndexChecksum(files.file()); err != nil {
+			log.Fatalf("Verify failed: %v", err)
+		}
+
+	case "use":
+		useFlags := newFlagSet("use", "[flags] [name]", "Select the collection commands use, or list the collections.")
+		reset := useFlags.Bool("default", false, "go back to the default index")
+		useFlags.Parse(args[1:])
+
+		var err error
+		switch {
+		case *reset:
+			err = useCollection("")
+		case useFlags.NArg() > 0:
+			err = useCollection(useFlags.Arg(0))
+		default:
+			err = listCollections(os.Stdout)
+		}
+		if err != nil {
+			log.Fatalf("Use failed: %v", err)
+		}
+
+	case "help":
+		printUsage()
+
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		printUsage()
@@ -0,0 +1,208 @@
+//go:build sqlite
+
+// SQLite storage for -db, only compiled with -tags sqlite so the default
+// build carries no database driver. The driver, pinned in go.mod, is pure
+// Go, so no C compiler is needed:
+//
+//	go build -tags sqlite -o xkcd .
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	openDB = openSQLiteStore
+}
+
+// Each comic is a row holding its JSON, so show reads one row instead of
+// the whole index. meta holds the rest of the Index under the key "index".
+// The _bak tables keep the previous save, for 'restore'.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS comics (num INTEGER PRIMARY KEY, comic TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS comics_bak (num INTEGER PRIMARY KEY, comic TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS meta_bak (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+`
+
+// sqliteStore keeps the index in a SQLite database. Favorites, tags,
+// history and the audit log stay in the jsonStore side files beside it.
+type sqliteStore struct {
+	*jsonStore
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection: SQLite serializes writers anyway, and this keeps
+	// transactions from waiting on each other within the process
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s is not a usable SQLite database: %v", path, err)
+	}
+	return &sqliteStore{jsonStore: &jsonStore{path: path}, db: db}, nil
+}
+
+func (s *sqliteStore) Load() (*Index, error) {
+	return loadSQLiteIndex(s.db, "comics", "meta")
+}
+
+// loadSQLiteIndex reads an index from a pair of tables; an empty database
+// loads as an empty index, like a missing JSON file
+func loadSQLiteIndex(db *sql.DB, comicsTable, metaTable string) (*Index, error) {
+	var index Index
+	var meta string
+	err := db.QueryRow("SELECT value FROM " + metaTable + " WHERE key = 'index'").Scan(&meta)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal([]byte(meta), &index); err != nil {
+			return nil, fmt.Errorf("index metadata is corrupt: %v", err)
+		}
+	}
+
+	index.Comics = make(map[int]*Comic)
+	rows, err := db.Query("SELECT num, comic FROM " + comicsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var num int
+		var data string
+		if err := rows.Scan(&num, &data); err != nil {
+			return nil, err
+		}
+		var comic Comic
+		if err := json.Unmarshal([]byte(data), &comic); err != nil {
+			return nil, fmt.Errorf("comic #%d is corrupt: %v", num, err)
+		}
+		index.Comics[num] = &comic
+	}
+	return &index, rows.Err()
+}
+
+// Save replaces the whole index in one transaction, after copying the
+// current one to the _bak tables. Like the JSON store, nothing is backed
+// up until there is a previous save.
+func (s *sqliteStore) Save(index *Index) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var saved int
+	if err := tx.QueryRow("SELECT count(*) FROM meta").Scan(&saved); err != nil {
+		return err
+	}
+	if saved > 0 {
+		for _, stmt := range []string{
+			"DELETE FROM comics_bak",
+			"DELETE FROM meta_bak",
+			"INSERT INTO comics_bak SELECT * FROM comics",
+			"INSERT INTO meta_bak SELECT * FROM meta",
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("backing up the previous index: %v", err)
+			}
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM comics"); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare("INSERT INTO comics (num, comic) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for num, comic := range index.Comics {
+		data, err := json.Marshal(comic)
+		if err != nil {
+			return err
+		}
+		if _, err := insert.Exec(num, string(data)); err != nil {
+			return err
+		}
+	}
+
+	// Everything but the comics, which have their own rows
+	meta := *index
+	meta.Comics = nil
+	data, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES ('index', ?)", string(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get reads the one row it needs
+func (s *sqliteStore) Get(num int) (*Comic, bool, error) {
+	var data string
+	err := s.db.QueryRow("SELECT comic FROM comics WHERE num = ?", num).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var comic Comic
+	if err := json.Unmarshal([]byte(data), &comic); err != nil {
+		return nil, false, fmt.Errorf("comic #%d is corrupt: %v", num, err)
+	}
+	return &comic, true, nil
+}
+
+// Restore swaps the tables with their backups by renaming them, so
+// restoring twice gets back to where it started
+func (s *sqliteStore) Restore() error {
+	var saved int
+	if err := s.db.QueryRow("SELECT count(*) FROM meta_bak").Scan(&saved); err != nil {
+		return err
+	}
+	if saved == 0 {
+		return fmt.Errorf("no backup of %s yet; one is kept from the next save", s.path)
+	}
+	if _, err := loadSQLiteIndex(s.db, "comics_bak", "meta_bak"); err != nil {
+		return fmt.Errorf("the backup can't be used: %v", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"comics", "meta"} {
+		for _, stmt := range []string{
+			"ALTER TABLE " + table + " RENAME TO " + table + "_swap",
+			"ALTER TABLE " + table + "_bak RENAME TO " + table,
+			"ALTER TABLE " + table + "_swap RENAME TO " + table + "_bak",
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// setGlobal sets a package variable, such as a flag, for the rest of the test
+func setGlobal[T any](t *testing.T, p *T, value T) {
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in         string
+		start, end time.Time
+		wantErr    bool
+	}{
+		{in: "2015", start: date(2015, 1, 1), end: date(2016, 1, 1)},
+		{in: "2015-03", start: date(2015, 3, 1), end: date(2015, 4, 1)},
+		{in: "2015/03", start: date(2015, 3, 1), end: date(2015, 4, 1)},
+		{in: "2015-12", start: date(2015, 12, 1), end: date(2016, 1, 1)},
+		{in: "2015-03-14", start: date(2015, 3, 14), end: date(2015, 3, 15)},
+		{in: "2015/03/14", start: date(2015, 3, 14), end: date(2015, 3, 15)},
+		{in: "2015-12-31", start: date(2015, 12, 31), end: date(2016, 1, 1)},
+		{in: "2016-02-29", start: date(2016, 2, 29), end: date(2016, 3, 1)},
+
+		{in: "", wantErr: true},
+		{in: "yesterday", wantErr: true},
+		{in: "15", wantErr: true},
+		{in: "2015-3-14", wantErr: true},
+		{in: "14-03-2015", wantErr: true},
+		{in: "2015-03-14T10:00", wantErr: true},
+		{in: "2015-13", wantErr: true},
+		{in: "2015-00", wantErr: true},
+		{in: "2015-02-30", wantErr: true},
+		{in: "2015-02-29", wantErr: true},
+		{in: "2015-04-31", wantErr: true},
+		{in: "2015/13/01", wantErr: true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseDate(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseDate(%q) = %v, %v; want an error", tt.in, start, end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDate(%q): %v", tt.in, err)
+			continue
+		}
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("parseDate(%q) = [%v, %v); want [%v, %v)", tt.in, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestWrapLongURL(t *testing.T) {
+	url := "https://example.com/" + strings.Repeat("abcdefghij", 18)
+	if n := utf8.RuneCountInString(url); n != 200 {
+		t.Fatalf("test URL is %d characters, want 200", n)
+	}
+
+	for _, width := range []int{20, 37, 60, 199, 200} {
+		lines := wrapText("see "+url+" for more", width)
+		for _, line := range lines {
+			if n := utf8.RuneCountInString(line); n > width {
+				t.Errorf("width %d: line %q is %d characters wide", width, line, n)
+			}
+		}
+		joined := strings.ReplaceAll(strings.Join(lines, " "), wrapContinuation+" ", "")
+		if joined != "see "+url+" for more" {
+			t.Errorf("width %d: wrapped text reads %q", width, joined)
+		}
+	}
+
+	// Narrower than anything sensible: no panic, and nothing is lost
+	for _, width := range []int{1, 0, -5} {
+		lines := breakWord(url, width)
+		if strings.ReplaceAll(strings.Join(lines, ""), wrapContinuation, "") != url {
+			t.Errorf("breakWord(url, %d) lost text: %q", width, lines)
+		}
+		if lines := wrapText(url, width); len(lines) == 0 {
+			t.Errorf("wrapText(url, %d) returned no lines", width)
+		}
+	}
+}
+
+func TestDisplayComicBoxWithLongURL(t *testing.T) {
+	setGlobal(t, &plainSet, true)
+	setGlobal(t, plainFlag, false)
+	setGlobal(t, widthFlag, 40)
+	url := "https://example.com/" + strings.Repeat("abcdefghij", 18)
+	comic := &Comic{Num: 1, Title: "Long", Year: "2020", Month: "1", Day: "2",
+		Link: url, Alt: "Alt " + url, Transcript: url}
+
+	var buf bytes.Buffer
+	displayComic(&buf, comic, nil)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if n := visibleWidth(line); n != 44 {
+			t.Errorf("line is %d columns, want 44: %q", n, line)
+		}
+		first, _ := utf8.DecodeRuneInString(line)
+		last, _ := utf8.DecodeLastRuneInString(line)
+		if !strings.ContainsRune("│┌├└", first) || !strings.ContainsRune("│┐┤┘", last) {
+			t.Errorf("line isn't framed by the box: %q", line)
+		}
+	}
+}
+
+// shouldColor's precedence, highest first: CLICOLOR_FORCE or -color,
+// then -no-color, then NO_COLOR or CLICOLOR=0, then whether stdout is a
+// terminal. The null device is a character device, so it stands in for a
+// terminal.
+func TestShouldColorPrecedence(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	if !isTerminal(devNull) {
+		t.Skipf("%s isn't a character device here", os.DevNull)
+	}
+
+	tests := []struct {
+		name                  string
+		env                   map[string]string
+		color, noColor, onTTY bool
+		want                  bool
+	}{
+		{name: "not a terminal", want: false},
+		{name: "terminal", onTTY: true, want: true},
+		{name: "NO_COLOR on a terminal", env: map[string]string{"NO_COLOR": "1"}, onTTY: true, want: false},
+		{name: "CLICOLOR=0 on a terminal", env: map[string]string{"CLICOLOR": "0"}, onTTY: true, want: false},
+		{name: "CLICOLOR=1 on a terminal", env: map[string]string{"CLICOLOR": "1"}, onTTY: true, want: true},
+		{name: "-no-color on a terminal", noColor: true, onTTY: true, want: false},
+		{name: "-no-color beats CLICOLOR", env: map[string]string{"CLICOLOR": "1"}, noColor: true, onTTY: true, want: false},
+		{name: "-color without a terminal", color: true, want: true},
+		{name: "-color beats NO_COLOR", env: map[string]string{"NO_COLOR": "1"}, color: true, want: true},
+		{name: "-color beats -no-color", color: true, noColor: true, want: true},
+		{name: "CLICOLOR_FORCE without a terminal", env: map[string]string{"CLICOLOR_FORCE": "1"}, want: true},
+		{name: "CLICOLOR_FORCE beats NO_COLOR", env: map[string]string{"CLICOLOR_FORCE": "1", "NO_COLOR": "1"}, want: true},
+		{name: "CLICOLOR_FORCE beats -no-color", env: map[string]string{"CLICOLOR_FORCE": "1"}, noColor: true, want: true},
+		{name: "CLICOLOR_FORCE=0 is unset", env: map[string]string{"CLICOLOR_FORCE": "0", "NO_COLOR": "1"}, onTTY: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"CLICOLOR_FORCE", "NO_COLOR", "CLICOLOR"} {
+				t.Setenv(name, tt.env[name])
+			}
+			setGlobal(t, colorFlag, tt.color)
+			setGlobal(t, noColorFlag, tt.noColor)
+			if tt.onTTY {
+				setGlobal(t, &os.Stdout, devNull)
+			}
+
+			if got := shouldColor(); got != tt.want {
+				t.Errorf("shouldColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Widths count runes, so accented letters take one column, not their two
+// bytes in UTF-8
+func TestWrapTextCountsRunes(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"crème brûlée", 12, []string{"crème brûlée"}},
+		{"Café crème brûlée naïve façade élève", 12, []string{"Café crème", "brûlée naïve", "façade élève"}},
+		{"[Ångström über alles]", 10, []string{"[Ångström", "über", "alles]"}},
+		{"Émilie—naïveté", 8, []string{"Émilie—" + wrapContinuation, "naïveté"}},
+	}
+	for _, tt := range tests {
+		if got := wrapText(tt.text, tt.width); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrapText(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestPickRandomDistribution(t *testing.T) {
+	var comics []*Comic
+	for num := 1; num <= 11; num++ {
+		if num != 4 {
+			comics = append(comics, &Comic{Num: num, Title: fmt.Sprintf("Comic %d", num), Year: "2010", Month: "1", Day: strconv.Itoa(num)})
+		}
+	}
+	store := testStore(comics...)
+
+	const draws = 20000
+	counts := make(map[int]int)
+	rng := newRand(42)
+	for range draws {
+		comic, err := pickRandom(store, rng, randomFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[comic.Num]++
+	}
+	if counts[4] != 0 {
+		t.Errorf("picked comic #4, which isn't indexed")
+	}
+	// Each of the 10 comics is expected draws/10 times; a fair pick stays
+	// well within 10% of that
+	for _, comic := range comics {
+		if n := counts[comic.Num]; n < draws/10*9/10 || n > draws/10*11/10 {
+			t.Errorf("comic #%d picked %d times out of %d, want about %d", comic.Num, n, draws, draws/10)
+		}
+	}
+
+	// The same seed picks the same comics
+	a, b := newRand(7), newRand(7)
+	for range 100 {
+		x, _ := pickRandom(store, a, randomFilter{})
+		y, _ := pickRandom(store, b, randomFilter{})
+		if x.Num != y.Num {
+			t.Fatalf("seed 7 picked #%d and then #%d", x.Num, y.Num)
+		}
+	}
+
+	// A date filter only picks within the range
+	dates, err := newDateRange("2010-01-09", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		comic, err := pickRandom(store, rng, randomFilter{dates: dates})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if comic.Num < 9 {
+			t.Fatalf("picked #%d, published before the range", comic.Num)
+		}
+	}
+
+	if _, err := pickRandom(testStore(), rng, randomFilter{}); err == nil {
+		t.Errorf("picked a comic from an empty index")
+	}
+}
+
+func TestGzipIndexRoundTrip(t *testing.T) {
+	index := &Index{
+		Comics: map[int]*Comic{
+			1:   {Num: 1, Title: "Barrel - Part 1", Year: "2006", Month: "1", Day: "1", Alt: "Don't we all.", Img: "https://imgs.xkcd.com/comics/barrel_cropped_(1).jpg"},
+			353: {Num: 353, Title: "Python", Year: "2007", Month: "12", Day: "5", Alt: "I wrote 20 short programs in Python yesterday.", Transcript: "[[ Guy 1 is talking to Guy 2, who is floating in the sky ]]\nGuy 1: You're flying! How?"},
+		},
+		LastNum: 353,
+		Updated: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json.gz")
+	if err := saveIndex(path, index); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		t.Fatalf("%s isn't gzip-compressed", path)
+	}
+
+	// Compression is detected from the content, whatever the name
+	renamed := filepath.Join(dir, "index.json")
+	if err := os.WriteFile(renamed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, renamed} {
+		loaded, err := loadIndex(p)
+		if err != nil {
+			t.Fatalf("loading %s: %v", p, err)
+		}
+		if !reflect.DeepEqual(loaded.Comics, index.Comics) {
+			t.Errorf("%s: comics = %v, want %v", p, loaded.Comics, index.Comics)
+		}
+		if loaded.LastNum != index.LastNum || !loaded.Updated.Equal(index.Updated) {
+			t.Errorf("%s: loaded %+v, want %+v", p, loaded, index)
+		}
+	}
+}
+
+func TestContiguousLastNum(t *testing.T) {
+	index := &Index{
+		Comics: map[int]*Comic{1: {Num: 1}, 2: {Num: 2}, 5: {Num: 5}, 6: {Num: 6}},
+		Absent: []int{4},
+	}
+	tests := []struct {
+		lastNum, limit, want int
+	}{
+		{1, 6, 2}, // #3 is missing, so #4-#6 don't count
+		{3, 6, 6}, // #4 is absent, which doesn't stop it
+		{3, 5, 5}, // Never past limit
+		{6, 3, 6}, // Never backwards
+	}
+	for _, tt := range tests {
+		index.LastNum = tt.lastNum
+		if got := contiguousLastNum(index, tt.limit); got != tt.want {
+			t.Errorf("contiguousLastNum from %d up to %d = %d, want %d", tt.lastNum, tt.limit, got, tt.want)
+		}
+	}
+}
+
+// fakeXKCD answers like xkcd.com's JSON API with the comics up to latest,
+// except for the numbers in failing, which get a 500
+type fakeXKCD struct {
+	latest  int
+	failing map[int]bool
+}
+
+func (x *fakeXKCD) RoundTrip(req *http.Request) (*http.Response, error) {
+	num := x.latest
+	if req.URL.Path != "/info.0.json" {
+		fmt.Sscanf(req.URL.Path, "/%d/info.0.json", &num)
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Request: req}
+	if x.failing[num] {
+		resp.StatusCode = http.StatusInternalServerError
+		resp.Body = io.NopCloser(strings.NewReader("oops"))
+		return resp, nil
+	}
+	body := fmt.Sprintf(`{"num": %d, "title": "Comic %d", "safe_title": "Comic %d", "year": "2020", "month": "1", "day": "%d", "img": "https://imgs.xkcd.com/comics/%d.png"}`, num, num, num, num, num)
+	resp.Body = io.NopCloser(strings.NewReader(body))
+	return resp, nil
+}
+
+// A comic that fails in the middle of an update must hold LastNum back,
+// so the next update fetches it again instead of skipping it
+func TestUpdateDoesNotSkipFailedComic(t *testing.T) {
+	server := &fakeXKCD{latest: 5, failing: map[int]bool{3: true}}
+	store := &jsonStore{path: filepath.Join(t.TempDir(), "index.json")}
+	f := newFetcher(&http.Client{Transport: server}, "test", 0, 0)
+	opts := updateOptions{workers: 2, progress: "summary"}
+
+	if _, err := updateIndex(context.Background(), store, f, opts); err != nil {
+		t.Fatal(err)
+	}
+	index, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.LastNum != 2 {
+		t.Errorf("LastNum = %d after #3 failed, want 2", index.LastNum)
+	}
+	for _, num := range []int{1, 2, 4, 5} {
+		if index.Comics[num] == nil {
+			t.Errorf("comic #%d wasn't saved", num)
+		}
+	}
+
+	// Once #3 can be fetched, the next update fills it in
+	server.failing = nil
+	if _, err := updateIndex(context.Background(), store, f, opts); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if index.LastNum != 5 || index.Comics[3] == nil {
+		t.Errorf("after a retry LastNum = %d and #3 = %v, want 5 and comic #3", index.LastNum, index.Comics[3])
+	}
+}
+
+// testStore holds an index made of comics in memory
+func testStore(comics ...*Comic) Store {
+	index := &Index{Comics: make(map[int]*Comic)}
+	for _, comic := range comics {
+		index.Comics[comic.Num] = comic
+		index.LastNum = max(index.LastNum, comic.Num)
+	}
+	return loadedStore{index: index}
+}
+
+// searchNums returns the numbers of the comics matching query, in order
+func searchNums(t *testing.T, store Store, query string, opts searchOptions) []int {
+	t.Helper()
+	results, err := search(store, query, opts)
+	if err != nil {
+		t.Fatalf("search %q: %v", query, err)
+	}
+	var nums []int
+	for _, result := range results {
+		nums = append(nums, result.Comic.Num)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+func TestSearchWholeWord(t *testing.T) {
+	store := testStore(
+		&Comic{Num: 1, Title: "Google", Alt: "Googling things."},
+		&Comic{Num: 2, Title: "Start", Alt: "Ready, set, go."},
+		&Comic{Num: 3, Title: "Race", Transcript: "[[A starting pistol fires]]\nGo!"},
+		&Comic{Num: 4, Title: "Long ago", Alt: "A cargo ship."},
+		&Comic{Num: 5, Title: "Go-kart", Alt: "Vroom."},
+	)
+	tests := []struct {
+		query     string
+		wholeWord bool
+		want      []int
+	}{
+		{"go", false, []int{1, 2, 3, 4, 5}},
+		{"go", true, []int{2, 3, 5}},
+		{"google", true, []int{1}},
+		{"goog", true, nil},
+		{"goog", false, []int{1}},
+		{`"set go"`, true, []int{2}},
+	}
+	for _, tt := range tests {
+		got := searchNums(t, store, tt.query, searchOptions{wholeWord: tt.wholeWord})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q (whole word %v) = %v, want %v", tt.query, tt.wholeWord, got, tt.want)
+		}
+	}
+}
+
+// Each field a term occurs in adds its weight once: there is no extra
+// score for the text as a whole, so no match is counted twice
+func TestScoreFields(t *testing.T) {
+	contains := func(text string) bool { return strings.Contains(text, "python") }
+	tests := []struct {
+		name string
+		text comicText
+		want int
+	}{
+		{"nowhere", comicText{"title", "title", "alt", "transcript"}, 0},
+		{"title", comicText{"python", "", "", ""}, titleWeight},
+		{"title and safe title", comicText{"python", "python", "", ""}, titleWeight + safeTitleWeight},
+		{"alt", comicText{"", "", "i like python", ""}, altWeight},
+		{"transcript", comicText{"", "", "", "python python python"}, transcriptWeight},
+		{"everywhere", comicText{"python", "python", "python", "python"}, 26},
+	}
+	for _, tt := range tests {
+		if got := scoreFields(&tt.text, contains); got != tt.want {
+			t.Errorf("%s: scoreFields = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSearchScores(t *testing.T) {
+	store := testStore(
+		&Comic{Num: 353, Title: "Python", SafeTitle: "Python", Alt: "I wrote 20 short programs in Python yesterday.", Transcript: "Python!"},
+		&Comic{Num: 1, Title: "Snakes", SafeTitle: "Snakes", Alt: "Not a python."},
+		&Comic{Num: 2, Title: "Code", SafeTitle: "Code", Transcript: "import antigravity"},
+	)
+	tests := []struct {
+		query string
+		want  map[int]int
+	}{
+		{"python", map[int]int{353: 26, 1: altWeight}},
+		{"title:python", map[int]int{353: titleWeight}},
+		{"alt:python", map[int]int{353: altWeight, 1: altWeight}},
+		{"transcript:python", map[int]int{353: transcriptWeight}},
+		{"antigravity", map[int]int{2: transcriptWeight}},
+	}
+	for _, tt := range tests {
+		results, err := search(store, tt.query, searchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[int]int)
+		for _, result := range results {
+			got[result.Comic.Num] = result.Score
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q scores = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestDisplayComicGolden(t *testing.T) {
+	setGlobal(t, &plainSet, true)
+	setGlobal(t, plainFlag, false)
+	setGlobal(t, widthFlag, 60)
+	comic := &Comic{
+		Num: 1234, Title: "Douglas Engelbart (1925-2013)", Year: "2013", Month: "7", Day: "3",
+		Img:        "https://imgs.xkcd.com/comics/douglas_engelbart_1925_2013.png",
+		Alt:        "Actual quote from The Demo: '... an advantage of being online is that it keeps track of who you are and what you’re doing all the time ...'\nSecond line of alt.",
+		Transcript: "[[Engelbart at a keyboard]]\nEngelbart: I'd like to show you a mouse.",
+	}
+	const want = `┌─ XKCD #1234 ─────────────────────────────────────────────────┐
+│ Title: Douglas Engelbart (1925-2013)                         │
+│ Date:  2013-07-03                                            │
+│ URL:   https://xkcd.com/1234/                                │
+│ Image: https://imgs.xkcd.com/comics/douglas_engelbart_1925_↩ │
+│        2013.png                                              │
+├─ Alt Text ───────────────────────────────────────────────────┤
+│ Actual quote from The Demo: '... an advantage of being       │
+│ online is that it keeps track of who you are and what you’re │
+│ doing all the time ...'                                      │
+│ Second line of alt.                                          │
+├─ Transcript ─────────────────────────────────────────────────┤
+│ [[Engelbart at a keyboard]]                                  │
+│ Engelbart: I'd like to show you a mouse.                     │
+└──────────────────────────────────────────────────────────────┘
+`
+	var buf bytes.Buffer
+	displayComic(&buf, comic, nil)
+	if got := buf.String(); got != want {
+		t.Errorf("displayComic printed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestComicDate(t *testing.T) {
+	tests := []struct {
+		year, month, day string
+		want             time.Time // Zero for an invalid date
+	}{
+		{"2009", "11", "23", date(2009, 11, 23)},
+		{"2006", "1", "1", date(2006, 1, 1)},
+		{"2006", "01", "01", date(2006, 1, 1)},
+		{" 2006", "1 ", " 1 ", date(2006, 1, 1)},
+		{"2016", "2", "29", date(2016, 2, 29)},
+
+		{"", "", "", time.Time{}},
+		{"", "1", "1", time.Time{}},
+		{"2006", "", "1", time.Time{}},
+		{"2006", "1", "", time.Time{}},
+		{"2006", "Jan", "1", time.Time{}},
+		{"twenty", "1", "1", time.Time{}},
+		{"2006", "1", "1st", time.Time{}},
+		{"2006", "1.5", "1", time.Time{}},
+		{"0", "1", "1", time.Time{}},
+		{"2006", "0", "1", time.Time{}},
+		{"2006", "13", "1", time.Time{}},
+		{"2006", "1", "0", time.Time{}},
+		{"2006", "1", "32", time.Time{}},
+		{"2006", "-1", "1", time.Time{}},
+		{"2015", "2", "29", time.Time{}},
+		{"2015", "4", "31", time.Time{}},
+	}
+	for _, tt := range tests {
+		comic := &Comic{Num: 1, Year: tt.year, Month: tt.month, Day: tt.day}
+		got, err := comic.Date()
+		if tt.want.IsZero() {
+			if err == nil {
+				t.Errorf("Date() of %q-%q-%q = %v, want an error", tt.year, tt.month, tt.day, got)
+			} else if s := formatDate(comic); s != "????-??-??" {
+				t.Errorf("formatDate of %q-%q-%q = %q, want ????-??-??", tt.year, tt.month, tt.day, s)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("Date() of %q-%q-%q = %v, %v; want %v", tt.year, tt.month, tt.day, got, err, tt.want)
+		}
+	}
+}
+
+// Equal scores are ordered newest first, then by number, with undated
+// comics last, however the index happens to be iterated
+func TestSearchTieOrder(t *testing.T) {
+	store := testStore(
+		&Comic{Num: 10, Title: "Tie", Year: "2008", Month: "5", Day: "1"},
+		&Comic{Num: 11, Title: "Tie", Year: "2010", Month: "1", Day: "1"},
+		&Comic{Num: 12, Title: "Tie", Year: "2008", Month: "5", Day: "1"},
+		&Comic{Num: 13, Title: "Tie"},
+		&Comic{Num: 14, Title: "Tie", Year: "2009", Month: "2", Day: "30"},
+		&Comic{Num: 15, Title: "Tie", Year: "2007", Month: "3", Day: "3"},
+		&Comic{Num: 16, Title: "Tie", Alt: "tie", Year: "2001", Month: "1", Day: "1"},
+	)
+	want := []int{16, 11, 12, 10, 15, 14, 13}
+	for range 20 {
+		results, err := search(store, "tie", searchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, result := range results {
+			got = append(got, result.Comic.Num)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("search order = %v, want %v", got, want)
+		}
+
+		rand.Shuffle(len(results), func(i, j int) { results[i], results[j] = results[j], results[i] })
+		sortResults(results, "")
+		got = got[:0]
+		for _, result := range results {
+			got = append(got, result.Comic.Num)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("sortResults order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSearchCaseSensitive(t *testing.T) {
+	store := testStore(
+		&Comic{Num: 1, Title: "Python", Alt: "Monty Python."},
+		&Comic{Num: 2, Title: "Snakes", Alt: "A python in the grass."},
+		&Comic{Num: 3, Title: "PYTHON", Transcript: "PYTHON IS GREAT"},
+		&Comic{Num: 4, Title: "Java"},
+	)
+	tests := []struct {
+		query         string
+		caseSensitive bool
+		want          []int
+	}{
+		{"python", false, []int{1, 2, 3}},
+		{"PYTHON", false, []int{1, 2, 3}},
+		{"python", true, []int{2}},
+		{"Python", true, []int{1}},
+		{"PYTHON", true, []int{3}},
+		{"pYtHoN", true, nil},
+		{`"Monty Python"`, true, []int{1}},
+		{`"monty python"`, true, nil},
+		{"title:Python", true, []int{1}},
+	}
+	for _, tt := range tests {
+		got := searchNums(t, store, tt.query, searchOptions{caseSensitive: tt.caseSensitive})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q (case sensitive %v) = %v, want %v", tt.query, tt.caseSensitive, got, tt.want)
+		}
+	}
+}
+
+// syntheticIndex builds an index of n comics with titles, alt texts and
+// transcripts of random words, the same for every call with the same n
+func syntheticIndex(n int) *Index {
+	rng := rand.New(rand.NewSource(1))
+	vocab := []string{"python", "hammer", "physics", "velociraptor", "keyboard", "science", "graph", "the", "and", "of"}
+	for i := len(vocab); i < 5000; i++ {
+		vocab = append(vocab, fmt.Sprintf("word%d", i))
+	}
+	text := func(words int) string {
+		parts := make([]string, words)
+		for i := range parts {
+			parts[i] = vocab[rng.Intn(len(vocab))]
+		}
+		return strings.Join(parts, " ")
+	}
+
+	index := &Index{Comics: make(map[int]*Comic), LastNum: n}
+	for num := 1; num <= n; num++ {
+		title := text(3)
+		index.Comics[num] = &Comic{
+			Num: num, Title: title, SafeTitle: title, Alt: text(25), Transcript: text(150),
+			Year: strconv.Itoa(2006 + num%18), Month: strconv.Itoa(1 + num%12), Day: strconv.Itoa(1 + num%28),
+		}
+	}
+	return index
+}
+
+// BenchmarkSearchShards compares scoring the comics on one goroutine with
+// scoring them in shards across every CPU
+func BenchmarkSearchShards(b *testing.B) {
+	store := loadedStore{index: syntheticIndex(20000)}
+	// Build the lowercased text and word index first, which every search
+	// after the first reuses
+	if _, err := search(store, "science", searchOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	for _, procs := range slices.Compact([]int{1, runtime.NumCPU()}) {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			for b.Loop() {
+				if _, err := search(store, "science graph", searchOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSearchCorpus compares a search that lowercases the text of the
+// comics it reads, as the first search of an index does, with one reusing
+// the lowercased text kept with the index. corpus-MB is the memory that
+// text takes.
+func BenchmarkSearchCorpus(b *testing.B) {
+	index := syntheticIndex(20000)
+	words := index.searchWords()
+	b.Run("first", func(b *testing.B) {
+		for b.Loop() {
+			fresh := &Index{Comics: index.Comics, LastNum: index.LastNum, words: words}
+			if _, err := search(loadedStore{index: fresh}, "science graph", searchOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("repeated", func(b *testing.B) {
+		store := loadedStore{index: index}
+		if _, err := search(store, "science graph", searchOptions{}); err != nil {
+			b.Fatal(err)
+		}
+		for b.Loop() {
+			if _, err := search(store, "science graph", searchOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		size := 0
+		for _, text := range index.corpus {
+			size += len(text.title) + len(text.safeTitle) + len(text.alt) + len(text.transcript)
+		}
+		b.ReportMetric(float64(size)/1e6, "corpus-MB")
+	})
+}